@@ -5,6 +5,8 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
 
 	"github.com/caddyserver/caddy/v2"
@@ -17,31 +19,53 @@ import (
 // CountryRecord defines the structure for Country database lookups
 // Contains country-specific information including EU membership status
 type CountryRecord struct {
+	Continent struct {
+		Code  string            `maxminddb:"code"`  // Two-letter continent code (e.g., "EU", "NA")
+		Names map[string]string `maxminddb:"names"` // Continent names in different languages
+	} `maxminddb:"continent"`
+
 	Country struct {
 		ISOCode           string `maxminddb:"iso_code"`             // Two-letter country code (e.g., "DE", "US")
 		IsInEuropeanUnion bool   `maxminddb:"is_in_european_union"` // Whether country is in EU
+		Confidence        uint16 `maxminddb:"confidence"`           // Enterprise only: confidence 0-100
 	} `maxminddb:"country"`
 
 	RegisteredCountry struct {
-		IsInEuropeanUnion bool `maxminddb:"is_in_european_union"` // Whether registered country is in EU
+		ISOCode           string `maxminddb:"iso_code"`             // Country the IP block is registered to
+		IsInEuropeanUnion bool   `maxminddb:"is_in_european_union"` // Whether registered country is in EU
 	} `maxminddb:"registered_country"`
+
+	RepresentedCountry struct {
+		ISOCode string `maxminddb:"iso_code"` // Country represented by users of the IP (e.g., overseas military base)
+		Type    string `maxminddb:"type"`     // Type of entity, e.g. "military"
+	} `maxminddb:"represented_country"`
 }
 
 // CityRecord defines the structure for City database lookups
 // Contains city, subdivision, and location information
 type CityRecord struct {
 	City struct {
-		Names map[string]string `maxminddb:"names"` // City names in different languages
+		Names      map[string]string `maxminddb:"names"`      // City names in different languages
+		Confidence uint16            `maxminddb:"confidence"` // Enterprise only: confidence 0-100
 	} `maxminddb:"city"`
 
 	Location struct {
-		Latitude  float64 `maxminddb:"latitude"`  // Geographic latitude
-		Longitude float64 `maxminddb:"longitude"` // Geographic longitude
+		Latitude       float64 `maxminddb:"latitude"`        // Geographic latitude
+		Longitude      float64 `maxminddb:"longitude"`       // Geographic longitude
+		AccuracyRadius uint16  `maxminddb:"accuracy_radius"` // Accuracy of the coordinates in kilometers
+		TimeZone       string  `maxminddb:"time_zone"`       // IANA time zone (e.g., "Europe/Berlin")
+		MetroCode      uint    `maxminddb:"metro_code"`      // US only: Nielsen DMA metro code
 	} `maxminddb:"location"`
 
+	Postal struct {
+		Code string `maxminddb:"code"` // Postal code (e.g., "80331")
+	} `maxminddb:"postal"`
+
 	Subdivisions []struct {
-		IsoCode string `maxminddb:"iso_code"` // State/Province code (e.g., "CA", "BY")
-	} `maxminddb:"subdivisions"`
+		IsoCode    string            `maxminddb:"iso_code"`   // State/Province code (e.g., "CA", "BY")
+		Names      map[string]string `maxminddb:"names"`      // Subdivision names in different languages
+		Confidence uint16            `maxminddb:"confidence"` // Enterprise only: confidence 0-100
+	} `maxminddb:"subdivisions"` // Ordered from largest to smallest (e.g., England, then county)
 }
 
 // ASNRecord defines the structure for ASN database lookups
@@ -51,6 +75,91 @@ type ASNRecord struct {
 	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"` // ASN organization name
 }
 
+// AnonymousIPRecord defines the structure for Anonymous IP database lookups
+// Used for VPN, proxy, hosting provider and Tor exit node detection
+type AnonymousIPRecord struct {
+	IsAnonymous        bool `maxminddb:"is_anonymous"`         // Any of the anonymizer flags below
+	IsAnonymousVPN     bool `maxminddb:"is_anonymous_vpn"`     // Known VPN provider
+	IsHostingProvider  bool `maxminddb:"is_hosting_provider"`  // Hosting or cloud provider
+	IsPublicProxy      bool `maxminddb:"is_public_proxy"`      // Public proxy
+	IsResidentialProxy bool `maxminddb:"is_residential_proxy"` // Proxy on a residential ISP
+	IsTorExitNode      bool `maxminddb:"is_tor_exit_node"`     // Tor exit node
+}
+
+// ISPRecord defines the structure for ISP database lookups
+// Used for ISP, organization and mobile network information
+type ISPRecord struct {
+	ISP               string `maxminddb:"isp"`                 // Internet service provider name
+	Organization      string `maxminddb:"organization"`        // Organization the IP is assigned to
+	MobileCountryCode string `maxminddb:"mobile_country_code"` // Mobile country code (MCC)
+	MobileNetworkCode string `maxminddb:"mobile_network_code"` // Mobile network code (MNC)
+}
+
+// ConnectionTypeRecord defines the structure for Connection-Type database lookups
+type ConnectionTypeRecord struct {
+	ConnectionType string `maxminddb:"connection_type"` // Cable/DSL, Cellular, Corporate or Satellite
+}
+
+// EnterpriseRecord defines the structure for Enterprise database lookups
+// A single record contains the country, city, network and connection data
+type EnterpriseRecord struct {
+	CountryRecord
+	CityRecord
+
+	Traits struct {
+		AutonomousSystemNumber       uint64 `maxminddb:"autonomous_system_number"`
+		AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+		ISP                          string `maxminddb:"isp"`
+		Organization                 string `maxminddb:"organization"`
+		MobileCountryCode            string `maxminddb:"mobile_country_code"`
+		MobileNetworkCode            string `maxminddb:"mobile_network_code"`
+		ConnectionType               string `maxminddb:"connection_type"`
+	} `maxminddb:"traits"`
+}
+
+// LookupResult holds the combined results of all database lookups for one client IP
+// The geoip2_vars handler stores it in the request vars so that other handlers
+// (e.g. geoip2_block) can reuse it instead of performing the lookups again
+type LookupResult struct {
+	IP                     net.IP            // Client IP the lookups were performed for
+	CountryCode            string            // Two-letter country code
+	ContinentCode          string            // Two-letter continent code
+	ContinentName          string            // Localized continent name
+	IsInEU                 bool              // EU membership of country or registered country
+	RegisteredCountryCode  string            // Country the IP block is registered to
+	RepresentedCountryCode string            // Country represented by the users of the IP
+	RepresentedCountryType string            // Type of the represented country entity, e.g. "military"
+	City                   string            // Localized city name
+	Latitude               float64           // Geographic latitude
+	Longitude              float64           // Geographic longitude
+	AccuracyRadius         uint16            // Accuracy of the coordinates in kilometers
+	TimeZone               string            // IANA time zone
+	MetroCode              uint              // US metro code
+	PostalCode             string            // Postal code
+	Subdivisions           []Subdivision     // All subdivision levels, largest first
+	ASN                    uint64            // Autonomous System Number
+	ASOrg                  string            // Autonomous System Organization
+	CityDatabase           string            // Name of the city database that answered the City lookup
+	Network                netip.Prefix      // Network of the City (or Country) record, invalid if unknown
+	Anonymous              AnonymousIPRecord // Anonymizer flags from the Anonymous IP database
+	ISP                    ISPRecord         // ISP and mobile network data from the ISP database
+	ConnectionType         string            // Connection type from the Connection-Type database
+
+	// Enterprise is set if the Enterprise database answered the lookup
+	Enterprise bool
+
+	// Confidence values (0-100), only provided by Enterprise databases
+	CountryConfidence     uint16
+	CityConfidence        uint16
+	SubdivisionConfidence uint16
+}
+
+// Subdivision is one level of the subdivision hierarchy of a LookupResult
+type Subdivision struct {
+	Code string // Subdivision ISO code
+	Name string // Localized subdivision name
+}
+
 // GeoIP2 is the HTTP middleware handler that provides GeoIP2 functionality
 // It enriches requests with geographic information based on client IP
 type GeoIP2 struct {
@@ -58,9 +167,50 @@ type GeoIP2 struct {
 	// - "strict": only use remote IP address (ignore X-Forwarded-For)
 	// - "wild": trust X-Forwarded-For header unconditionally
 	// - "trusted_proxies": trust X-Forwarded-For only from trusted proxies (default)
+	// - "client_ip": use the client IP resolved by Caddy's server (trusted_proxies, client_ip_headers)
 	// - "off"/"false"/"0": disable GeoIP2 lookups
 	Enable string `json:"enable,omitempty"`
 
+	// Headers lists custom client IP headers in priority order, e.g. "CF-Connecting-IP"
+	// or "True-Client-IP"; they take precedence over Sources and are only
+	// trusted according to the Enable mode
+	Headers []string `json:"headers,omitempty"`
+
+	// Sources lists the forwarding headers consulted for the client IP, in priority order
+	// The first header present in the request is used:
+	// - "x_forwarded_for": the X-Forwarded-For header (default)
+	// - "forwarded": the RFC 7239 Forwarded header (for= parameter)
+	// Headers are only trusted according to the Enable mode
+	Sources []string `json:"sources,omitempty"`
+
+	// TrustedCIDRs lists proxy networks (CIDRs, single IPs or "private_ranges")
+	// The forwarding chain is walked from the right, skipping hops within these
+	// networks, and the first untrusted hop is used as client IP
+	// When empty, the rightmost entry (added by the trusted proxy) is used
+	TrustedCIDRs []string `json:"trusted_cidrs,omitempty"`
+
+	// Leftmost uses the leftmost entry of the forwarding chain instead of walking it from
+	// the right, if no TrustedCIDRs are configured
+	// The leftmost entry is supplied by the client and can be spoofed; the "wild" mode
+	// always uses it
+	Leftmost bool `json:"leftmost,omitempty"`
+
+	// MaxHops limits how many hops are examined from the right of the chain
+	// 0 = unlimited
+	MaxHops int `json:"max_hops,omitempty"`
+
+	// Languages is the preference list for localized names (city, continent, subdivisions)
+	// Defaults to the languages of the geoip2 app
+	// Example: ["en", "fr", "de"]
+	Languages []string `json:"languages,omitempty"`
+
+	// AcceptLanguage prefers the languages of the request's Accept-Language header
+	// over the configured Languages
+	AcceptLanguage bool `json:"accept_language,omitempty"`
+
+	// trustedCIDRs holds the parsed TrustedCIDRs, built once at provision time
+	trustedCIDRs []netip.Prefix `json:"-"`
+
 	// state holds reference to the shared GeoIP2 database state
 	state *GeoIP2State `json:"-"`
 
@@ -74,22 +224,64 @@ type IpSafeLevel int
 const (
 	Wild           IpSafeLevel = 0   // Trust any X-Forwarded-For header
 	TrustedProxies IpSafeLevel = 1   // Only trust X-Forwarded-For from trusted proxies
+	CaddyClientIP  IpSafeLevel = 2   // Use the client IP resolved by Caddy's server
 	Strict         IpSafeLevel = 100 // Never trust X-Forwarded-For, use RemoteAddr only
 )
 
+// Client IP sources for the Sources setting
+const (
+	SourceXForwardedFor = "x_forwarded_for"
+	SourceForwarded     = "forwarded"
+)
+
 // Variable names that will be set in Caddy's replacer
 // Using underscore notation instead of dots for better compatibility
 const (
-	VarCity         = "geoip2_city"
-	VarCountryCode  = "geoip2_country_code"
-	VarLatitude     = "geoip2_latitude"
-	VarLongitude    = "geoip2_longitude"
-	VarSubdivisions = "geoip2_subdivisions"
-	VarIsInEU       = "geoip2_is_in_eu"
-	VarASN          = "geoip2_asn"
-	VarASOrg        = "geoip2_asorg"
+	VarCity                   = "geoip2_city"
+	VarCountryCode            = "geoip2_country_code"
+	VarContinentCode          = "geoip2_continent_code"
+	VarContinentName          = "geoip2_continent_name"
+	VarRegisteredCountryCode  = "geoip2_registered_country_code"
+	VarRepresentedCountryCode = "geoip2_represented_country_code"
+	VarRepresentedCountryType = "geoip2_represented_country_type"
+	VarLatitude               = "geoip2_latitude"
+	VarLongitude              = "geoip2_longitude"
+	VarAccuracyRadius         = "geoip2_accuracy_radius"
+	VarTimeZone               = "geoip2_time_zone"
+	VarMetroCode              = "geoip2_metro_code"
+	VarPostalCode             = "geoip2_postal_code"
+	VarSubdivisions           = "geoip2_subdivisions"
+	VarSubdivision1Code       = "geoip2_subdivision_1_code"
+	VarSubdivision1Name       = "geoip2_subdivision_1_name"
+	VarSubdivision2Code       = "geoip2_subdivision_2_code"
+	VarSubdivision2Name       = "geoip2_subdivision_2_name"
+	VarIsInEU                 = "geoip2_is_in_eu"
+	VarASN                    = "geoip2_asn"
+	VarASOrg                  = "geoip2_asorg"
+	VarCitySource             = "geoip2_city_source"
+	VarNetwork                = "geoip2_network"
+
+	VarAnonIsAnonymous        = "geoip2_anon_is_anonymous"
+	VarAnonIsAnonymousVPN     = "geoip2_anon_is_anonymous_vpn"
+	VarAnonIsHostingProvider  = "geoip2_anon_is_hosting_provider"
+	VarAnonIsPublicProxy      = "geoip2_anon_is_public_proxy"
+	VarAnonIsResidentialProxy = "geoip2_anon_is_residential_proxy"
+	VarAnonIsTorExitNode      = "geoip2_anon_is_tor_exit_node"
+
+	VarISP               = "geoip2_isp"
+	VarOrganization      = "geoip2_organization"
+	VarMobileCountryCode = "geoip2_mobile_country_code"
+	VarMobileNetworkCode = "geoip2_mobile_network_code"
+	VarConnectionType    = "geoip2_connection_type"
+
+	VarCountryConfidence     = "geoip2_country_confidence"
+	VarCityConfidence        = "geoip2_city_confidence"
+	VarSubdivisionConfidence = "geoip2_subdivision_confidence"
 )
 
+// LookupResultVarKey is the request variable key under which the *LookupResult is stored
+const LookupResultVarKey = "geoip2_lookup_result"
+
 // Module registration - called when Caddy starts
 func init() {
 	caddy.RegisterModule(GeoIP2{})
@@ -135,6 +327,35 @@ func (m *GeoIP2) initializeVariables(repl *caddy.Replacer) {
 	repl.Set(VarIsInEU, "")
 	repl.Set(VarASN, "")
 	repl.Set(VarASOrg, "")
+	repl.Set(VarCitySource, "")
+	repl.Set(VarAnonIsAnonymous, "")
+	repl.Set(VarAnonIsAnonymousVPN, "")
+	repl.Set(VarAnonIsHostingProvider, "")
+	repl.Set(VarAnonIsPublicProxy, "")
+	repl.Set(VarAnonIsResidentialProxy, "")
+	repl.Set(VarAnonIsTorExitNode, "")
+	repl.Set(VarISP, "")
+	repl.Set(VarOrganization, "")
+	repl.Set(VarMobileCountryCode, "")
+	repl.Set(VarMobileNetworkCode, "")
+	repl.Set(VarConnectionType, "")
+	repl.Set(VarCountryConfidence, "")
+	repl.Set(VarCityConfidence, "")
+	repl.Set(VarSubdivisionConfidence, "")
+	repl.Set(VarContinentCode, "")
+	repl.Set(VarContinentName, "")
+	repl.Set(VarAccuracyRadius, "")
+	repl.Set(VarTimeZone, "")
+	repl.Set(VarMetroCode, "")
+	repl.Set(VarPostalCode, "")
+	repl.Set(VarSubdivision1Code, "")
+	repl.Set(VarSubdivision1Name, "")
+	repl.Set(VarSubdivision2Code, "")
+	repl.Set(VarSubdivision2Name, "")
+	repl.Set(VarRegisteredCountryCode, "")
+	repl.Set(VarRepresentedCountryCode, "")
+	repl.Set(VarRepresentedCountryType, "")
+	repl.Set(VarNetwork, "")
 }
 
 // isEnabled checks if GeoIP2 lookups should be performed
@@ -143,8 +364,6 @@ func (m *GeoIP2) isEnabled() bool {
 }
 
 // performLookup does the actual GeoIP2 database lookups and sets variables
-// Implements intelligent routing: EU IPs use Europe-specific city database,
-// non-EU IPs use global city database for optimal performance
 func (m *GeoIP2) performLookup(r *http.Request, repl *caddy.Replacer) {
 	// Check if databases are available
 	if m.state == nil {
@@ -160,137 +379,340 @@ func (m *GeoIP2) performLookup(r *http.Request, repl *caddy.Replacer) {
 		return
 	}
 
-	// Perform Country database lookup first (needed for EU routing decision)
+	// Perform all database lookups and share the result with later handlers
+	result := lookupClientIP(m.state, clientIP, m.languages(r))
+	caddyhttp.SetVar(r.Context(), LookupResultVarKey, result)
+
+	// Set all GeoIP2 variables with the combined results
+	repl.Set(VarCountryCode, result.CountryCode)
+	repl.Set(VarIsInEU, result.IsInEU)
+	repl.Set(VarContinentCode, result.ContinentCode)
+	repl.Set(VarContinentName, result.ContinentName)
+	repl.Set(VarRegisteredCountryCode, result.RegisteredCountryCode)
+	repl.Set(VarRepresentedCountryCode, result.RepresentedCountryCode)
+	repl.Set(VarRepresentedCountryType, result.RepresentedCountryType)
+	repl.Set(VarCity, result.City)
+	repl.Set(VarLatitude, result.Latitude)
+	repl.Set(VarLongitude, result.Longitude)
+	repl.Set(VarAccuracyRadius, result.AccuracyRadius)
+	repl.Set(VarTimeZone, result.TimeZone)
+	repl.Set(VarMetroCode, result.MetroCode)
+	repl.Set(VarPostalCode, result.PostalCode)
+	repl.Set(VarSubdivisions, result.subdivisionCodes())
+	for i, subdivision := range result.Subdivisions {
+		switch i {
+		case 0:
+			repl.Set(VarSubdivision1Code, subdivision.Code)
+			repl.Set(VarSubdivision1Name, subdivision.Name)
+		case 1:
+			repl.Set(VarSubdivision2Code, subdivision.Code)
+			repl.Set(VarSubdivision2Name, subdivision.Name)
+		}
+	}
+	repl.Set(VarASN, result.ASN)
+	repl.Set(VarASOrg, result.ASOrg)
+	repl.Set(VarCitySource, result.CityDatabase)
+	if result.Network.IsValid() {
+		repl.Set(VarNetwork, result.Network.String())
+	}
+	repl.Set(VarAnonIsAnonymous, result.Anonymous.IsAnonymous)
+	repl.Set(VarAnonIsAnonymousVPN, result.Anonymous.IsAnonymousVPN)
+	repl.Set(VarAnonIsHostingProvider, result.Anonymous.IsHostingProvider)
+	repl.Set(VarAnonIsPublicProxy, result.Anonymous.IsPublicProxy)
+	repl.Set(VarAnonIsResidentialProxy, result.Anonymous.IsResidentialProxy)
+	repl.Set(VarAnonIsTorExitNode, result.Anonymous.IsTorExitNode)
+	repl.Set(VarISP, result.ISP.ISP)
+	repl.Set(VarOrganization, result.ISP.Organization)
+	repl.Set(VarMobileCountryCode, result.ISP.MobileCountryCode)
+	repl.Set(VarMobileNetworkCode, result.ISP.MobileNetworkCode)
+	repl.Set(VarConnectionType, result.ConnectionType)
+	// Confidence 0 is a valid value, so the placeholders stay empty without an Enterprise record
+	if result.Enterprise {
+		repl.Set(VarCountryConfidence, result.CountryConfidence)
+		repl.Set(VarCityConfidence, result.CityConfidence)
+		repl.Set(VarSubdivisionConfidence, result.SubdivisionConfidence)
+	}
+
+	// Debug logging with performance information
+	caddy.Log().Named("http.handlers.geoip2").Debug("GeoIP2 lookups completed",
+		zap.String("ip", clientIP.String()),
+		zap.String("country", result.CountryCode),
+		zap.String("city", result.City),
+		zap.Bool("is_in_eu", result.IsInEU),
+		zap.String("city_database_used", result.CityDatabase),
+		zap.Uint64("asn", result.ASN))
+}
+
+// lookupClientIP performs the Country, City, ASN, Anonymous IP, ISP and Connection-Type lookups for a client IP
+// If an Enterprise database is configured, a single lookup in it replaces the Country, City,
+// ASN, ISP and Connection-Type lookups
+// Localized names are selected by the given language preference list
+func lookupClientIP(state *GeoIP2State, clientIP net.IP, languages []string) *LookupResult {
+	result := &LookupResult{IP: clientIP}
+
+	if state.HasDatabase(DatabaseEnterprise) {
+		lookupEnterprise(state, clientIP, result, languages)
+	} else {
+		lookupSeparateDatabases(state, clientIP, result, languages)
+	}
+
+	// Perform Anonymous IP database lookup
+	if state.HasDatabase(DatabaseAnonymousIP) {
+		if err := state.LookupAnonymousIP(clientIP, &result.Anonymous); err != nil {
+			caddy.Log().Named("http.handlers.geoip2").Debug("Anonymous IP lookup failed",
+				zap.String("ip", clientIP.String()),
+				zap.Error(err))
+		}
+	}
+
+	return result
+}
+
+// lookupEnterprise fills the result from a single Enterprise database record
+// One tree traversal instead of one per database
+func lookupEnterprise(state *GeoIP2State, clientIP net.IP, result *LookupResult, languages []string) {
+	var record EnterpriseRecord
+	network, err := state.LookupNetworkIn(DatabaseEnterprise, clientIP, &record)
+	if err != nil {
+		caddy.Log().Named("http.handlers.geoip2").Debug("Enterprise lookup failed",
+			zap.String("ip", clientIP.String()),
+			zap.Error(err))
+		return
+	}
+
+	result.Enterprise = true
+	applyCountryRecord(result, &record.CountryRecord, languages)
+	result.Network = network
+	// Same as lookupCity: the source is only reported if the record has city data
+	if record.hasCityNames() || record.hasLocation() {
+		result.CityDatabase = DatabaseEnterprise
+	}
+	applyCityRecord(result, &record.CityRecord, languages)
+
+	result.ASN = record.Traits.AutonomousSystemNumber
+	result.ASOrg = record.Traits.AutonomousSystemOrganization
+	result.ISP = ISPRecord{
+		ISP:               record.Traits.ISP,
+		Organization:      record.Traits.Organization,
+		MobileCountryCode: record.Traits.MobileCountryCode,
+		MobileNetworkCode: record.Traits.MobileNetworkCode,
+	}
+	result.ConnectionType = record.Traits.ConnectionType
+}
+
+// lookupSeparateDatabases fills the result from the individual Country, City, ASN, ISP and Connection-Type databases
+// Implements intelligent routing: the city database is selected by the app's city routes,
+// by default EU IPs use the Europe-specific and non-EU IPs the global city database
+func lookupSeparateDatabases(state *GeoIP2State, clientIP net.IP, result *LookupResult, languages []string) {
+	// Perform Country database lookup first (needed for city routing decision)
 	var countryRecord CountryRecord
-	var countryCode string
-	var isInEU bool
-	if m.state.CountryDBHandler != nil {
-		if err := m.state.Lookup(clientIP, &countryRecord); err != nil {
+	if state.HasDatabase(DatabaseCountry) {
+		network, err := state.LookupNetworkIn(DatabaseCountry, clientIP, &countryRecord)
+		if err != nil {
 			caddy.Log().Named("http.handlers.geoip2").Debug("Country lookup failed",
 				zap.String("ip", clientIP.String()),
 				zap.Error(err))
 		} else {
-			countryCode = countryRecord.Country.ISOCode
-			// Check both country and registered_country for EU status
-			isInEU = countryRecord.Country.IsInEuropeanUnion || countryRecord.RegisteredCountry.IsInEuropeanUnion
+			applyCountryRecord(result, &countryRecord, languages)
+			result.Network = network
 		}
 	}
 
-	// Perform intelligent City database lookup based on EU status
+	// Perform intelligent City database lookup based on the country lookup result
 	var cityRecord CityRecord
-	var cityName string
-	var latitude, longitude float64
-	var subdivision string
-
-	// Decide which city database to use based on EU status
-	var cityLookupFunc func(interface{}, interface{}) error
-	var dbName string
-
-	if isInEU && m.state.CityDBHandler != nil {
-		// EU IP: Use Europe-specific database
-		cityLookupFunc = m.state.LookupCity
-		dbName = "Europe city database"
-	} else if m.state.GlobalCityDBHandler != nil {
-		// Non-EU IP: Use global database as fallback
-		cityLookupFunc = m.state.LookupGlobalCity
-		dbName = "Global city database"
-	}
-
-	if cityLookupFunc != nil {
-		if err := cityLookupFunc(clientIP, &cityRecord); err != nil {
+	// Falls back to the next configured city database if the record has no city data
+	dbName, cityNetwork, err := state.lookupCity(clientIP, result.CountryCode, result.ContinentCode, result.IsInEU, &cityRecord)
+
+	if dbName != "" {
+		if err != nil {
 			caddy.Log().Named("http.handlers.geoip2").Debug("City lookup failed",
 				zap.String("ip", clientIP.String()),
 				zap.String("database", dbName),
-				zap.Bool("is_eu", isInEU),
+				zap.Bool("is_eu", result.IsInEU),
 				zap.Error(err))
 		} else {
-			// Extract city name (prefer German as specified in nginx config, fallback to English, then any)
-			if name, exists := cityRecord.City.Names["de"]; exists && name != "" {
-				cityName = name
-			} else if name, exists := cityRecord.City.Names["en"]; exists && name != "" {
-				cityName = name
-			} else {
-				// If no German or English name, try to get any available city name
-				for _, name := range cityRecord.City.Names {
-					if name != "" {
-						cityName = name
-						break
-					}
-				}
-			}
-
-			// Extract location data
-			latitude = cityRecord.Location.Latitude
-			longitude = cityRecord.Location.Longitude
-
-			// Extract subdivision (state/province) - use first available
-			if len(cityRecord.Subdivisions) > 0 && cityRecord.Subdivisions[0].IsoCode != "" {
-				subdivision = cityRecord.Subdivisions[0].IsoCode
+			result.CityDatabase = dbName
+			// City networks are more specific than Country networks
+			if cityNetwork.IsValid() {
+				result.Network = cityNetwork
 			}
+			applyCityRecord(result, &cityRecord, languages)
 
 			caddy.Log().Named("http.handlers.geoip2").Debug("City lookup successful",
 				zap.String("ip", clientIP.String()),
 				zap.String("database", dbName),
-				zap.Bool("is_eu", isInEU),
-				zap.String("city", cityName))
+				zap.Bool("is_eu", result.IsInEU),
+				zap.String("city", result.City))
 		}
 	}
 
 	// Perform ASN database lookup
 	var asnRecord ASNRecord
-	var asnNumber uint64
-	var asnOrg string
-	if m.state.ASNDBHandler != nil {
-		if err := m.state.LookupASN(clientIP, &asnRecord); err != nil {
+	if state.HasDatabase(DatabaseASN) {
+		if err := state.LookupASN(clientIP, &asnRecord); err != nil {
 			caddy.Log().Named("http.handlers.geoip2").Debug("ASN lookup failed",
 				zap.String("ip", clientIP.String()),
 				zap.Error(err))
 		} else {
-			asnNumber = asnRecord.AutonomousSystemNumber
-			asnOrg = asnRecord.AutonomousSystemOrganization
+			result.ASN = asnRecord.AutonomousSystemNumber
+			result.ASOrg = asnRecord.AutonomousSystemOrganization
 		}
 	}
 
-	// Set all GeoIP2 variables with the combined results
-	repl.Set(VarCountryCode, countryCode)
-	repl.Set(VarIsInEU, isInEU)
-	repl.Set(VarCity, cityName)
-	repl.Set(VarLatitude, latitude)
-	repl.Set(VarLongitude, longitude)
-	repl.Set(VarSubdivisions, subdivision)
-	repl.Set(VarASN, asnNumber)
-	repl.Set(VarASOrg, asnOrg)
+	// Perform ISP database lookup
+	if state.HasDatabase(DatabaseISP) {
+		if err := state.LookupISP(clientIP, &result.ISP); err != nil {
+			caddy.Log().Named("http.handlers.geoip2").Debug("ISP lookup failed",
+				zap.String("ip", clientIP.String()),
+				zap.Error(err))
+		}
+	}
 
-	// Debug logging with performance information
-	caddy.Log().Named("http.handlers.geoip2").Debug("GeoIP2 lookups completed",
-		zap.String("ip", clientIP.String()),
-		zap.String("country", countryCode),
-		zap.String("city", cityName),
-		zap.Bool("is_in_eu", isInEU),
-		zap.String("city_database_used", dbName),
-		zap.Uint64("asn", asnNumber))
+	// Perform Connection-Type database lookup
+	if state.HasDatabase(DatabaseConnectionType) {
+		var connectionTypeRecord ConnectionTypeRecord
+		if err := state.LookupConnectionType(clientIP, &connectionTypeRecord); err != nil {
+			caddy.Log().Named("http.handlers.geoip2").Debug("Connection-Type lookup failed",
+				zap.String("ip", clientIP.String()),
+				zap.Error(err))
+		} else {
+			result.ConnectionType = connectionTypeRecord.ConnectionType
+		}
+	}
+}
+
+// applyCountryRecord copies the country data of a Country or Enterprise record into the result
+func applyCountryRecord(result *LookupResult, record *CountryRecord, languages []string) {
+	result.CountryCode = record.Country.ISOCode
+	result.CountryConfidence = record.Country.Confidence
+	result.ContinentCode = record.Continent.Code
+	result.ContinentName = localizedName(record.Continent.Names, languages)
+	// Check both country and registered_country for EU status
+	result.IsInEU = record.Country.IsInEuropeanUnion || record.RegisteredCountry.IsInEuropeanUnion
+	result.RegisteredCountryCode = record.RegisteredCountry.ISOCode
+	result.RepresentedCountryCode = record.RepresentedCountry.ISOCode
+	result.RepresentedCountryType = record.RepresentedCountry.Type
+}
+
+// applyCityRecord copies the city data of a City or Enterprise record into the result
+func applyCityRecord(result *LookupResult, record *CityRecord, languages []string) {
+	result.City = localizedName(record.City.Names, languages)
+	result.CityConfidence = record.City.Confidence
+
+	// Extract location data
+	result.Latitude = record.Location.Latitude
+	result.Longitude = record.Location.Longitude
+	result.AccuracyRadius = record.Location.AccuracyRadius
+	result.TimeZone = record.Location.TimeZone
+	result.MetroCode = record.Location.MetroCode
+	result.PostalCode = record.Postal.Code
+
+	// Extract subdivisions (state/province, then smaller levels such as counties)
+	result.Subdivisions = make([]Subdivision, 0, len(record.Subdivisions))
+	for _, subdivision := range record.Subdivisions {
+		result.Subdivisions = append(result.Subdivisions, Subdivision{
+			Code: subdivision.IsoCode,
+			Name: localizedName(subdivision.Names, languages),
+		})
+	}
+	if len(record.Subdivisions) > 0 && record.Subdivisions[0].IsoCode != "" {
+		result.SubdivisionConfidence = record.Subdivisions[0].Confidence
+	}
+}
+
+// subdivisionCodes returns the ISO codes of all subdivision levels as a comma-separated list
+// Example: "ENG,WSX"
+func (result *LookupResult) subdivisionCodes() string {
+	codes := make([]string, 0, len(result.Subdivisions))
+	for _, subdivision := range result.Subdivisions {
+		if subdivision.Code != "" {
+			codes = append(codes, subdivision.Code)
+		}
+	}
+	return strings.Join(codes, ",")
+}
+
+// languages returns the language preference list for localized names of a request
+func (m *GeoIP2) languages(r *http.Request) []string {
+	languages := m.Languages
+	if len(languages) == 0 {
+		languages = m.state.languages()
+	}
+	if !m.AcceptLanguage {
+		return languages
+	}
+
+	accepted := parseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if len(accepted) == 0 {
+		return languages
+	}
+	return append(accepted, languages...)
+}
+
+// requestLookupResult returns the LookupResult stored by geoip2_vars earlier in the route,
+// or performs the lookups for Caddy's resolved client IP if none is available
+func requestLookupResult(state *GeoIP2State, r *http.Request) (*LookupResult, error) {
+	if result, ok := caddyhttp.GetVar(r.Context(), LookupResultVarKey).(*LookupResult); ok {
+		return result, nil
+	}
+
+	clientIP, err := resolvedClientIP(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := lookupClientIP(state, clientIP, state.languages())
+	caddyhttp.SetVar(r.Context(), LookupResultVarKey, result)
+	return result, nil
 }
 
 // getClientIP determines the real client IP address based on configuration
-// Handles X-Forwarded-For header according to security settings
+// Handles forwarding headers (X-Forwarded-For, Forwarded) according to security settings
 func (m GeoIP2) getClientIP(r *http.Request) (net.IP, error) {
 	var ipStr string
 
-	// Determine if we're behind a trusted proxy
-	trustedProxy := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool)
-
 	// Convert string setting to safety level
 	safeLevel := m.getSafetyLevel()
 
-	// Get X-Forwarded-For header if present
-	forwardedFor := r.Header.Get("X-Forwarded-For")
+	// Delegate to Caddy so that geolocation agrees with access logs and client_ip matchers
+	if safeLevel == CaddyClientIP {
+		return resolvedClientIP(r)
+	}
 
-	// Decide which IP to use based on safety level and proxy trust
-	if ((safeLevel == TrustedProxies && trustedProxy) || safeLevel == Wild) && forwardedFor != "" {
-		// Use X-Forwarded-For header (take first IP in chain)
-		ips := strings.Split(forwardedFor, ", ")
-		ipStr = strings.TrimSpace(ips[0])
-	} else {
+	// Determine if we're behind a trusted proxy
+	trustedProxy, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool)
+
+	// Decide whether forwarding headers may be used based on safety level and proxy trust
+	if (safeLevel == TrustedProxies && trustedProxy) || safeLevel == Wild {
+		// Custom client IP headers are authoritative, use the first one with a valid IP
+		// Values like "unknown" are skipped in favor of the next header or source
+		for _, name := range m.Headers {
+			if value := r.Header.Get(name); value != "" {
+				first, _, _ := strings.Cut(value, ",")
+				if first = strings.TrimSpace(first); parseHopIP(first) != nil {
+					ipStr = first
+					break
+				}
+			}
+		}
+
+		// Otherwise use the first configured forwarding source that is present
+		if ipStr == "" {
+			for _, source := range m.sources() {
+				if hops := forwardedHops(r, source); len(hops) > 0 {
+					ipStr = m.selectHop(hops)
+					// RFC 7239 "unknown" and obfuscated identifiers (e.g. "_hidden") hide the
+					// client, so the direct connection is the best address we have
+					if parseHopIP(ipStr) == nil {
+						ipStr = ""
+					}
+					break
+				}
+			}
+		}
+	}
+
+	if ipStr == "" {
 		// Use direct connection IP from RemoteAddr
 		var err error
 		ipStr, _, err = net.SplitHostPort(r.RemoteAddr)
@@ -306,6 +728,85 @@ func (m GeoIP2) getClientIP(r *http.Request) (net.IP, error) {
 	}
 
 	// Parse and validate IP address
+	parsedIP := parseHopIP(ipStr)
+	if parsedIP == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", ipStr)
+	}
+
+	return parsedIP, nil
+}
+
+// selectHop picks the client IP from a forwarding chain ordered client -> last proxy
+// The chain is walked from the right, examining at most MaxHops hops, and the first hop
+// outside the trusted networks is returned; without trusted networks that is the rightmost hop
+// The client-supplied leftmost entry is only used in "wild" mode or if Leftmost is set,
+// and only without trusted networks or a hop limit
+// Returns "" if all examined hops are trusted, so that a proxy is never geolocated
+func (m *GeoIP2) selectHop(hops []string) string {
+	if len(m.trustedCIDRs) == 0 && m.MaxHops == 0 && (m.Leftmost || m.getSafetyLevel() == Wild) {
+		return hops[0]
+	}
+
+	first := 0
+	if m.MaxHops > 0 && len(hops) > m.MaxHops {
+		first = len(hops) - m.MaxHops
+	}
+
+	for i := len(hops) - 1; i >= first; i-- {
+		ip := parseHopIP(hops[i])
+		if ip == nil || !m.isTrustedHop(ip) {
+			// Invalid hops are never trusted; the caller falls back to RemoteAddr
+			return hops[i]
+		}
+	}
+
+	// All examined hops are our own proxies, none of them is the client
+	return ""
+}
+
+// isTrustedHop reports whether ip lies within one of the trusted CIDRs
+func (m *GeoIP2) isTrustedHop(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range m.trustedCIDRs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sources returns the configured client IP sources or the default
+func (m *GeoIP2) sources() []string {
+	if len(m.Sources) == 0 {
+		return []string{SourceXForwardedFor}
+	}
+	return m.Sources
+}
+
+// resolvedClientIP returns the client IP as resolved by Caddy's HTTP server
+// This honors the server's trusted_proxies, client_ip_headers and
+// trusted_proxies_strict settings, just like Caddy's own client_ip matcher
+func resolvedClientIP(r *http.Request) (net.IP, error) {
+	address, _ := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	if address == "" {
+		address = r.RemoteAddr
+	}
+
+	ipStr, _, err := net.SplitHostPort(address)
+	if err != nil {
+		// Address probably didn't have a port
+		ipStr = address
+	}
+
+	// Strip IPv6 zone identifier if present
+	if i := strings.IndexByte(ipStr, '%'); i >= 0 {
+		ipStr = ipStr[:i]
+	}
+
 	parsedIP := net.ParseIP(ipStr)
 	if parsedIP == nil {
 		return nil, fmt.Errorf("invalid IP address: %s", ipStr)
@@ -321,6 +822,8 @@ func (m *GeoIP2) getSafetyLevel() IpSafeLevel {
 		return Strict
 	case "wild":
 		return Wild
+	case "client_ip":
+		return CaddyClientIP
 	default:
 		return TrustedProxies
 	}
@@ -334,13 +837,81 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler
-// Parses: geoip2_vars <mode>
+// Parses:
+//
+//	geoip2_vars <mode> {
+//	  header CF-Connecting-IP True-Client-IP
+//	  source forwarded x_forwarded_for
+//	  trusted_cidrs 10.0.0.0/8 private_ranges
+//	  max_hops 3
+//	  leftmost
+//	  languages en fr de
+//	  accept_language
+//	}
 func (m *GeoIP2) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		// Parse the mode argument (strict/wild/trusted_proxies)
 		if !d.Args(&m.Enable) {
 			return d.ArgErr()
 		}
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "header":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.Headers = append(m.Headers, args...)
+
+			case "source":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.Sources = append(m.Sources, args...)
+
+			case "trusted_cidrs":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.TrustedCIDRs = append(m.TrustedCIDRs, args...)
+
+			case "leftmost":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Leftmost = true
+
+			case "max_hops":
+				var hopsStr string
+				if !d.Args(&hopsStr) {
+					return d.ArgErr()
+				}
+				hops, err := strconv.Atoi(hopsStr)
+				if err != nil {
+					return d.Errf("invalid max_hops '%s': %v", hopsStr, err)
+				}
+				m.MaxHops = hops
+
+			case "languages":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.Languages = append(m.Languages, args...)
+
+			case "accept_language":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.AcceptLanguage = true
+
+			default:
+				return d.Errf("unknown subdirective: %s", d.Val())
+			}
+		}
 	}
 	return nil
 }
@@ -360,6 +931,13 @@ func (g *GeoIP2) Provision(ctx caddy.Context) error {
 	g.state = app.(*GeoIP2State)
 	g.ctx = ctx
 
+	// Parse trusted proxy networks for hop selection
+	trustedCIDRs, err := parseTrustedCIDRs(g.TrustedCIDRs)
+	if err != nil {
+		return err
+	}
+	g.trustedCIDRs = trustedCIDRs
+
 	return nil
 }
 
@@ -367,8 +945,21 @@ func (g *GeoIP2) Provision(ctx caddy.Context) error {
 func (g GeoIP2) Validate() error {
 	caddy.Log().Named("http.handlers.geoip2").Debug("validating GeoIP2 handler")
 
+	// Validate Sources setting
+	for _, source := range g.Sources {
+		if source != SourceXForwardedFor && source != SourceForwarded {
+			return fmt.Errorf("invalid source '%s', must be one of: %v", source,
+				[]string{SourceXForwardedFor, SourceForwarded})
+		}
+	}
+
+	// Validate MaxHops setting
+	if g.MaxHops < 0 {
+		return fmt.Errorf("max_hops cannot be negative")
+	}
+
 	// Validate Enable setting
-	validModes := []string{"strict", "wild", "trusted_proxies", "off", "false", "0", ""}
+	validModes := []string{"strict", "wild", "trusted_proxies", "client_ip", "off", "false", "0", ""}
 	mode := strings.ToLower(g.Enable)
 	for _, valid := range validModes {
 		if mode == valid {
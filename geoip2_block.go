@@ -0,0 +1,409 @@
+package geoip2
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/rewrite"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// GeoIP2Block is an HTTP handler that allows or rejects requests based on
+// the client's country, continent, EU membership and ASN
+// Rules are evaluated in order and the first matching rule decides
+// If geoip2_vars ran earlier in the route its lookup result is reused,
+// otherwise the lookups are performed for Caddy's resolved client IP
+//
+// Caddyfile usage:
+//
+//	geoip2_block {
+//	  deny country CN RU KP
+//	  deny asn 16509 64512-65534
+//	  allow continent EU NA
+//	  default deny
+//	  status 451
+//	  body "Not available in your region"
+//	}
+type GeoIP2Block struct {
+	// Rules is the ordered list of allow/deny rules
+	Rules []*BlockRule `json:"rules,omitempty"`
+
+	// DefaultAction is applied when no rule matches: "allow" or "deny"
+	// Defaults to "deny" if all rules are allow rules, otherwise "allow"
+	DefaultAction string `json:"default_action,omitempty"`
+
+	// StatusCode is the HTTP status returned for rejected requests
+	// Default: 403
+	StatusCode int `json:"status_code,omitempty"`
+
+	// Body is the response body for rejected requests (placeholders supported)
+	// If empty and no rewrite is configured, an HTTP error is returned
+	// so that handle_errors routes can render the response
+	Body string `json:"body,omitempty"`
+
+	// Rewrite is the URI rejected requests are rewritten to before being
+	// passed to the next handler, instead of responding directly
+	// Example: "/blocked.html"
+	Rewrite string `json:"rewrite,omitempty"`
+
+	// rewrite is the provisioned rewrite handler for Rewrite
+	rewrite *rewrite.Rewrite `json:"-"`
+
+	// hits counts matched requests per rule
+	hits *prometheus.CounterVec `json:"-"`
+
+	// state holds reference to the shared GeoIP2 database state
+	state *GeoIP2State `json:"-"`
+}
+
+// BlockRule is a single allow or deny rule of the geoip2_block handler
+// A rule matches if any of its criteria matches the lookup result
+type BlockRule struct {
+	// Name identifies the rule in logs and metrics
+	// Defaults to the action and criteria, e.g. "deny country CN RU", so that rules
+	// of different handlers don't share a metrics series by position
+	Name string `json:"name,omitempty"`
+
+	// Action is either "allow" or "deny"
+	Action string `json:"action"`
+
+	// Countries is a list of ISO country codes
+	Countries []string `json:"countries,omitempty"`
+
+	// Continents is a list of continent codes (AF, AN, AS, EU, NA, OC, SA)
+	Continents []string `json:"continents,omitempty"`
+
+	// InEU matches on EU membership if set (true = EU members, false = non-members)
+	InEU *bool `json:"in_eu,omitempty"`
+
+	// ASNs is a list of AS numbers or ranges, e.g. "16509" or "64512-65534"
+	ASNs []string `json:"asns,omitempty"`
+
+	// countries, continents and asnRanges are built once at provision time
+	countries  map[string]struct{} `json:"-"`
+	continents map[string]struct{} `json:"-"`
+	asnRanges  []asnRange          `json:"-"`
+}
+
+// Block rule actions
+const (
+	BlockActionAllow = "allow"
+	BlockActionDeny  = "deny"
+)
+
+// blockRuleHitsOpts describes the block rule hit counter shared by all handler instances
+var blockRuleHitsOpts = prometheus.CounterOpts{
+	Namespace: "caddy",
+	Subsystem: "geoip2_block",
+	Name:      "rule_hits_total",
+	Help:      "Number of requests matched by each geoip2_block rule.",
+}
+
+// Module registration - called when Caddy starts
+func init() {
+	caddy.RegisterModule(GeoIP2Block{})
+	httpcaddyfile.RegisterHandlerDirective("geoip2_block", parseBlockCaddyfile)
+}
+
+// CaddyModule returns module information for Caddy's module system
+func (GeoIP2Block) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geoip2_block",
+		New: func() caddy.Module { return new(GeoIP2Block) },
+	}
+}
+
+// parseBlockCaddyfile parses the geoip2_block directive
+func parseBlockCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var m GeoIP2Block
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return &m, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler
+// Parses the geoip2_block block; each allow/deny line becomes one rule:
+//
+//	<allow|deny> country <code...>
+//	<allow|deny> continent <code...>
+//	<allow|deny> asn <asn|range...>
+//	<allow|deny> eu|non_eu
+func (m *GeoIP2Block) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case BlockActionAllow, BlockActionDeny:
+				rule := &BlockRule{Action: d.Val()}
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+
+				switch args[0] {
+				case "country":
+					if len(args) < 2 {
+						return d.ArgErr()
+					}
+					rule.Countries = args[1:]
+				case "continent":
+					if len(args) < 2 {
+						return d.ArgErr()
+					}
+					rule.Continents = args[1:]
+				case "asn":
+					if len(args) < 2 {
+						return d.ArgErr()
+					}
+					rule.ASNs = args[1:]
+				case "eu", "non_eu":
+					if len(args) != 1 {
+						return d.ArgErr()
+					}
+					inEU := args[0] == "eu"
+					rule.InEU = &inEU
+				default:
+					return d.Errf("unknown rule criterion: %s", args[0])
+				}
+				m.Rules = append(m.Rules, rule)
+
+			case "default":
+				if !d.Args(&m.DefaultAction) {
+					return d.ArgErr()
+				}
+
+			case "status":
+				var statusStr string
+				if !d.Args(&statusStr) {
+					return d.ArgErr()
+				}
+				status, err := strconv.Atoi(statusStr)
+				if err != nil {
+					return d.Errf("invalid status code '%s': %v", statusStr, err)
+				}
+				m.StatusCode = status
+
+			case "body":
+				if !d.Args(&m.Body) {
+					return d.ArgErr()
+				}
+
+			case "rewrite":
+				if !d.Args(&m.Rewrite) {
+					return d.ArgErr()
+				}
+
+			default:
+				return d.Errf("unknown subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Provision links the handler to the shared GeoIP2 state and compiles the rules
+func (m *GeoIP2Block) Provision(ctx caddy.Context) error {
+	caddy.Log().Named("http.handlers.geoip2_block").Debug("provisioning GeoIP2 block handler")
+
+	app, err := ctx.App(moduleName)
+	if err != nil {
+		return fmt.Errorf("getting geoip2 app: %v", err)
+	}
+	m.state = app.(*GeoIP2State)
+
+	for _, rule := range m.Rules {
+		if rule.Name == "" {
+			rule.Name = rule.defaultName()
+		}
+		if err := rule.provision(); err != nil {
+			return fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+	}
+
+	if m.DefaultAction == "" {
+		m.DefaultAction = BlockActionAllow
+		if len(m.Rules) > 0 && m.onlyAllowRules() {
+			m.DefaultAction = BlockActionDeny
+		}
+	}
+	if m.StatusCode == 0 {
+		m.StatusCode = http.StatusForbidden
+	}
+
+	if m.Rewrite != "" {
+		m.rewrite = &rewrite.Rewrite{URI: m.Rewrite}
+		if err := m.rewrite.Provision(ctx); err != nil {
+			return fmt.Errorf("provisioning rewrite: %v", err)
+		}
+	}
+
+	// Register the hit counter, reusing it if another instance already did
+	hits, err := registerCollector(ctx.GetMetricsRegistry(),
+		prometheus.NewCounterVec(blockRuleHitsOpts, []string{"rule", "action"}))
+	if err != nil {
+		return err
+	}
+	m.hits = hits
+
+	return nil
+}
+
+// onlyAllowRules reports whether all configured rules are allow rules
+func (m *GeoIP2Block) onlyAllowRules() bool {
+	for _, rule := range m.Rules {
+		if rule.Action != BlockActionAllow {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultName describes the rule by its action and criteria
+// Example: "deny country CN RU asn 64512-65534"
+func (rule *BlockRule) defaultName() string {
+	parts := []string{rule.Action}
+	if len(rule.Countries) > 0 {
+		parts = append(append(parts, "country"), rule.Countries...)
+	}
+	if len(rule.Continents) > 0 {
+		parts = append(append(parts, "continent"), rule.Continents...)
+	}
+	if len(rule.ASNs) > 0 {
+		parts = append(append(parts, "asn"), rule.ASNs...)
+	}
+	if rule.InEU != nil {
+		if *rule.InEU {
+			parts = append(parts, "eu")
+		} else {
+			parts = append(parts, "non_eu")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// provision compiles the rule's criteria into lookup sets and ranges
+func (rule *BlockRule) provision() error {
+	rule.countries = codeSet(rule.Countries)
+	rule.continents = codeSet(rule.Continents)
+
+	rule.asnRanges = make([]asnRange, 0, len(rule.ASNs))
+	for _, asn := range rule.ASNs {
+		r, err := parseASNRange(asn)
+		if err != nil {
+			return err
+		}
+		rule.asnRanges = append(rule.asnRanges, r)
+	}
+
+	return nil
+}
+
+// matches reports whether any of the rule's criteria matches the lookup result
+func (rule *BlockRule) matches(result *LookupResult) bool {
+	if result.CountryCode != "" {
+		if _, ok := rule.countries[result.CountryCode]; ok {
+			return true
+		}
+	}
+	if result.ContinentCode != "" {
+		if _, ok := rule.continents[result.ContinentCode]; ok {
+			return true
+		}
+	}
+	// EU membership is only meaningful if the country lookup succeeded
+	if rule.InEU != nil && result.CountryCode != "" && *rule.InEU == result.IsInEU {
+		return true
+	}
+	return asnRangesContain(rule.asnRanges, result.ASN)
+}
+
+// Validate checks if the configuration is valid
+func (m GeoIP2Block) Validate() error {
+	for i, rule := range m.Rules {
+		if rule.Action != BlockActionAllow && rule.Action != BlockActionDeny {
+			return fmt.Errorf("rule %d: invalid action '%s', must be 'allow' or 'deny'", i, rule.Action)
+		}
+		if len(rule.Countries) == 0 && len(rule.Continents) == 0 && len(rule.ASNs) == 0 && rule.InEU == nil {
+			return fmt.Errorf("rule %d: at least one criterion is required", i)
+		}
+	}
+	if m.DefaultAction != BlockActionAllow && m.DefaultAction != BlockActionDeny {
+		return fmt.Errorf("invalid default_action '%s', must be 'allow' or 'deny'", m.DefaultAction)
+	}
+	if m.StatusCode < 100 || m.StatusCode > 999 {
+		return fmt.Errorf("invalid status_code %d", m.StatusCode)
+	}
+	return nil
+}
+
+// ServeHTTP implements the HTTP middleware interface
+func (m *GeoIP2Block) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if m.state == nil {
+		caddy.Log().Named("http.handlers.geoip2_block").Warn("GeoIP2 state not available")
+		return next.ServeHTTP(w, r)
+	}
+
+	result, err := requestLookupResult(m.state, r)
+	if err != nil {
+		caddy.Log().Named("http.handlers.geoip2_block").Debug("failed to get client IP",
+			zap.Error(err))
+		result = &LookupResult{}
+	}
+
+	// First matching rule decides, otherwise the default action applies
+	action, ruleName := m.DefaultAction, "default"
+	for _, rule := range m.Rules {
+		if rule.matches(result) {
+			action, ruleName = rule.Action, rule.Name
+			break
+		}
+	}
+	m.hits.WithLabelValues(ruleName, action).Inc()
+
+	if action == BlockActionAllow {
+		return next.ServeHTTP(w, r)
+	}
+
+	caddy.Log().Named("http.handlers.geoip2_block").Info("request blocked",
+		zap.String("ip", result.IP.String()),
+		zap.String("country", result.CountryCode),
+		zap.String("continent", result.ContinentCode),
+		zap.Uint64("asn", result.ASN),
+		zap.String("rule", ruleName))
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	// Rewrite and continue, e.g. to serve a static "not available" page
+	if m.rewrite != nil {
+		m.rewrite.Rewrite(r, repl)
+		return next.ServeHTTP(w, r)
+	}
+
+	// Without a body let the error routes render the response
+	if m.Body == "" {
+		return caddyhttp.Error(m.StatusCode, fmt.Errorf("request blocked by geoip2_block rule %s", ruleName))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(m.StatusCode)
+	_, err = w.Write([]byte(repl.ReplaceKnown(m.Body, "")))
+	return err
+}
+
+// Interface guards - compile-time checks that we implement required interfaces
+var (
+	_ caddy.Module                = (*GeoIP2Block)(nil)
+	_ caddy.Provisioner           = (*GeoIP2Block)(nil)
+	_ caddy.Validator             = (*GeoIP2Block)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GeoIP2Block)(nil)
+	_ caddyfile.Unmarshaler       = (*GeoIP2Block)(nil)
+)
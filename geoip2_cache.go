@@ -0,0 +1,476 @@
+package geoip2
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"net/netip"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CacheConfig configures the in-process lookup cache of the geoip2 app
+// Cached lookups are invalidated whenever a database is (re)loaded
+type CacheConfig struct {
+	// Size is the maximum number of cached lookups across all shards
+	// Default: 10000
+	Size int `json:"size,omitempty"`
+
+	// TTL is how long a cached lookup stays valid
+	// 0 = until evicted or the database is reloaded
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// Shards is the number of independently locked cache partitions
+	// More shards reduce lock contention under high concurrency
+	// Default: 16
+	Shards int `json:"shards,omitempty"`
+}
+
+// Default cache configuration values
+const (
+	DefaultCacheSize   = 10000
+	DefaultCacheShards = 16
+)
+
+// CacheStats holds the statistics of the lookup cache
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+}
+
+// lookupCache is a sharded, size-bounded LRU cache of decoded database records
+// Entries are keyed by database name, network prefix and record type: a record applies
+// to the whole network the database returned it for, so one entry covers e.g. an entire
+// /24 or /48, and the same network can be cached for different result structures
+// The snapshot generation is part of the key, so lookups still running on a replaced
+// snapshot can't mix their results into those of the current databases
+// Records are deep-copied on put and get, so callers never share maps or slices with the cache
+type lookupCache struct {
+	shards []*cacheShard
+	ttl    time.Duration
+	seed   maphash.Seed
+
+	// prefixLengths holds the prefix lengths cached per database and address family,
+	// most specific first; a lookup probes the IP masked to each of them
+	prefixMutex   sync.RWMutex
+	prefixLengths map[prefixLengthsKey][]int
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+
+	// metrics mirror the statistics for Prometheus once registered
+	metrics cacheMetrics
+}
+
+// cacheMetrics are the Prometheus collectors of the lookup cache
+type cacheMetrics struct {
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	evictions prometheus.Counter
+	entries   prometheus.Gauge
+}
+
+// Prometheus metric descriptions of the lookup cache
+var (
+	cacheHitsOpts = prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "geoip2_cache",
+		Name:      "hits_total",
+		Help:      "Number of geoip2 lookups answered from the cache.",
+	}
+	cacheMissesOpts = prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "geoip2_cache",
+		Name:      "misses_total",
+		Help:      "Number of geoip2 lookups not found in the cache.",
+	}
+	cacheEvictionsOpts = prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "geoip2_cache",
+		Name:      "evictions_total",
+		Help:      "Number of geoip2 cache entries evicted to make room for new ones.",
+	}
+	cacheEntriesOpts = prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "geoip2_cache",
+		Name:      "entries",
+		Help:      "Number of entries in the geoip2 lookup cache.",
+	}
+)
+
+// cacheKey identifies a cached record
+type cacheKey struct {
+	database   string
+	generation uint64
+	network    netip.Prefix
+	typ        reflect.Type
+}
+
+// prefixLengthsKey identifies the prefix lengths of a database and address family
+type prefixLengthsKey struct {
+	database string
+	is4      bool
+}
+
+// cacheEntry is a cached record with its expiry time
+type cacheEntry struct {
+	key     cacheKey
+	value   interface{}
+	expires time.Time
+}
+
+// cacheShard is one LRU partition of the cache
+type cacheShard struct {
+	mutex    sync.Mutex
+	capacity int
+	items    map[cacheKey]*list.Element
+	order    *list.List // front = most recently used
+}
+
+// newLookupCache creates a cache from its configuration, applying defaults
+func newLookupCache(config *CacheConfig) *lookupCache {
+	size := config.Size
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	shardCount := config.Shards
+	if shardCount <= 0 {
+		shardCount = DefaultCacheShards
+	}
+	if shardCount > size {
+		shardCount = size
+	}
+
+	c := &lookupCache{
+		shards:        make([]*cacheShard, shardCount),
+		ttl:           time.Duration(config.TTL),
+		seed:          maphash.MakeSeed(),
+		prefixLengths: make(map[prefixLengthsKey][]int),
+		// Unregistered until registerMetrics is called
+		metrics: cacheMetrics{
+			hits:      prometheus.NewCounter(cacheHitsOpts),
+			misses:    prometheus.NewCounter(cacheMissesOpts),
+			evictions: prometheus.NewCounter(cacheEvictionsOpts),
+			entries:   prometheus.NewGauge(cacheEntriesOpts),
+		},
+	}
+	// Distribute the capacity, rounding up so the shards hold at least size entries
+	capacity := (size + shardCount - 1) / shardCount
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			capacity: capacity,
+			items:    make(map[cacheKey]*list.Element),
+			order:    list.New(),
+		}
+	}
+	return c
+}
+
+// registerMetrics registers the cache metrics, reusing collectors that are already registered
+// Must be called before the cache is used
+func (c *lookupCache) registerMetrics(registry *prometheus.Registry) error {
+	var err error
+	if c.metrics.hits, err = registerCollector(registry, c.metrics.hits); err != nil {
+		return err
+	}
+	if c.metrics.misses, err = registerCollector(registry, c.metrics.misses); err != nil {
+		return err
+	}
+	if c.metrics.evictions, err = registerCollector(registry, c.metrics.evictions); err != nil {
+		return err
+	}
+	if c.metrics.entries, err = registerCollector(registry, c.metrics.entries); err != nil {
+		return err
+	}
+	return nil
+}
+
+// registerCollector registers a collector, returning the existing one if it is already registered
+func registerCollector[T prometheus.Collector](registry *prometheus.Registry, collector T) (T, error) {
+	if err := registry.Register(collector); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if !errors.As(err, &are) {
+			return collector, fmt.Errorf("registering metrics: %v", err)
+		}
+		existing, ok := are.ExistingCollector.(T)
+		if !ok {
+			return collector, fmt.Errorf("registering metrics: unexpected collector type %T", are.ExistingCollector)
+		}
+		return existing, nil
+	}
+	return collector, nil
+}
+
+// resultType returns the type of a lookup result; ok is false if the result cannot be cached
+func resultType(result interface{}) (reflect.Type, bool) {
+	v := reflect.ValueOf(result)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, false
+	}
+	return v.Type(), true
+}
+
+// deepCopy returns a copy of v that shares no maps, slices or pointers with it
+// Unexported struct fields cannot be set through reflection and are copied shallowly
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type().Elem())
+		out.Elem().Set(deepCopy(v.Elem()))
+		return out
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(v.Type()).Elem()
+		out.Set(deepCopy(v.Elem()))
+		return out
+
+	case reflect.Struct:
+		out := reflect.New(v.Type()).Elem()
+		out.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if field := out.Field(i); field.CanSet() {
+				field.Set(deepCopy(v.Field(i)))
+			}
+		}
+		return out
+
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), deepCopy(iter.Value()))
+		}
+		return out
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return out
+
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return out
+
+	default:
+		return v
+	}
+}
+
+// ipAddr converts an IP to a netip.Addr, unmapping IPv4-mapped IPv6 addresses
+func ipAddr(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	return addr.Unmap(), ok
+}
+
+// networkPrefix converts a network returned by the reader to a netip.Prefix
+func networkPrefix(network *net.IPNet) (netip.Prefix, bool) {
+	if network == nil {
+		return netip.Prefix{}, false
+	}
+	addr, ok := netip.AddrFromSlice(network.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	bits, _ := network.Mask.Size()
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+		bits -= 96
+	}
+	if bits < 0 {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr, bits).Masked(), true
+}
+
+// shard returns the partition responsible for a key
+func (c *lookupCache) shard(key cacheKey) *cacheShard {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	h.WriteString(key.database)
+	addr := key.network.Addr().As16()
+	h.Write(addr[:])
+	h.WriteByte(byte(key.network.Bits()))
+	return c.shards[h.Sum64()%uint64(len(c.shards))]
+}
+
+// get copies the cached record of the network containing ip into result
+// Returns the network and whether a record was found
+func (c *lookupCache) get(database string, generation uint64, ip net.IP, result interface{}) (netip.Prefix, bool) {
+	typ, ok := resultType(result)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	addr, ok := ipAddr(ip)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+
+	c.prefixMutex.RLock()
+	lengths := c.prefixLengths[prefixLengthsKey{database, addr.Is4()}]
+	c.prefixMutex.RUnlock()
+
+	// Networks in a database don't overlap, so at most one prefix length matches
+	for _, bits := range lengths {
+		network, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if c.getEntry(cacheKey{database: database, generation: generation, network: network, typ: typ}, result) {
+			c.hits.Add(1)
+			c.metrics.hits.Inc()
+			return network, true
+		}
+	}
+
+	c.misses.Add(1)
+	c.metrics.misses.Inc()
+	return netip.Prefix{}, false
+}
+
+// getEntry copies a cached record into result and reports whether it was found and valid
+func (c *lookupCache) getEntry(key cacheKey, result interface{}) bool {
+	s := c.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	elem, found := s.items[key]
+	if !found {
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		s.order.Remove(elem)
+		delete(s.items, key)
+		c.metrics.entries.Dec()
+		return false
+	}
+	s.order.MoveToFront(elem)
+	reflect.ValueOf(result).Elem().Set(deepCopy(reflect.ValueOf(entry.value)))
+	return true
+}
+
+// put stores a copy of a decoded record for its network, evicting the least
+// recently used entry if the shard is full
+func (c *lookupCache) put(database string, generation uint64, network netip.Prefix, result interface{}) {
+	typ, ok := resultType(result)
+	if !ok || !network.IsValid() {
+		return
+	}
+	c.addPrefixLength(database, network)
+
+	key := cacheKey{database: database, generation: generation, network: network, typ: typ}
+	entry := &cacheEntry{
+		key:   key,
+		value: deepCopy(reflect.ValueOf(result).Elem()).Interface(),
+	}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+
+	s := c.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if elem, exists := s.items[key]; exists {
+		elem.Value = entry
+		s.order.MoveToFront(elem)
+		return
+	}
+
+	s.items[key] = s.order.PushFront(entry)
+	c.metrics.entries.Inc()
+	if s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*cacheEntry).key)
+		c.evictions.Add(1)
+		c.metrics.evictions.Inc()
+		c.metrics.entries.Dec()
+	}
+}
+
+// addPrefixLength records the prefix length of a cached network, keeping the lengths sorted
+func (c *lookupCache) addPrefixLength(database string, network netip.Prefix) {
+	key := prefixLengthsKey{database, network.Addr().Is4()}
+	bits := network.Bits()
+
+	c.prefixMutex.RLock()
+	lengths := c.prefixLengths[key]
+	c.prefixMutex.RUnlock()
+	for _, l := range lengths {
+		if l == bits {
+			return
+		}
+	}
+
+	c.prefixMutex.Lock()
+	defer c.prefixMutex.Unlock()
+	lengths = c.prefixLengths[key]
+	for _, l := range lengths {
+		if l == bits {
+			return
+		}
+	}
+	// Copy on write, so readers can use their slice without holding the lock
+	updated := append(append(make([]int, 0, len(lengths)+1), lengths...), bits)
+	sort.Sort(sort.Reverse(sort.IntSlice(updated)))
+	c.prefixLengths[key] = updated
+}
+
+// clear removes all entries, e.g. after a database reload
+func (c *lookupCache) clear() {
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		c.metrics.entries.Sub(float64(len(s.items)))
+		s.items = make(map[cacheKey]*list.Element)
+		s.order.Init()
+		s.mutex.Unlock()
+	}
+
+	c.prefixMutex.Lock()
+	c.prefixLengths = make(map[prefixLengthsKey][]int)
+	c.prefixMutex.Unlock()
+}
+
+// stats returns the current cache statistics
+func (c *lookupCache) stats() CacheStats {
+	stats := CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		stats.Entries += s.order.Len()
+		s.mutex.Unlock()
+	}
+	return stats
+}
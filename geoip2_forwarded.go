@@ -0,0 +1,135 @@
+package geoip2
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// privateRanges are the networks expanded from the "private_ranges" shorthand
+var privateRanges = []string{
+	"192.168.0.0/16",
+	"172.16.0.0/12",
+	"10.0.0.0/8",
+	"127.0.0.1/8",
+	"fd00::/8",
+	"::1",
+}
+
+// forwardedHops returns the client IP chain announced by a forwarding header source,
+// ordered from the original client (leftmost) to the last proxy (rightmost)
+// Returns nil if the header is not present in the request
+func forwardedHops(r *http.Request, source string) []string {
+	switch source {
+	case SourceXForwardedFor:
+		// Multiple header lines form one list; commas may or may not be followed by spaces
+		var ips []string
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, ip := range strings.Split(value, ",") {
+				if ip = strings.TrimSpace(ip); ip != "" {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		return ips
+
+	case SourceForwarded:
+		return parseForwarded(r.Header.Values("Forwarded"))
+	}
+	return nil
+}
+
+// parseForwarded extracts the for= values of RFC 7239 Forwarded headers
+// Multiple header lines are treated as one comma-separated list
+// Example: `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`
+// yields ["192.0.2.60", "[2001:db8:cafe::17]:4711"]
+func parseForwarded(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			for _, pair := range splitQuoted(element, ';') {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "for") {
+					continue
+				}
+				val = strings.TrimSpace(val)
+				if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+					val = strings.ReplaceAll(val[1:len(val)-1], `\"`, `"`)
+				}
+				hops = append(hops, val)
+			}
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s at sep, ignoring separators inside quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	inQuotes, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\' && inQuotes:
+			escaped = true
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseHopIP parses a single hop of a forwarding header into an IP
+// Accepts plain IPv4/IPv6 addresses, "ip:port", bracketed "[ipv6]" and "[ipv6]:port"
+// Returns nil for invalid values, including RFC 7239 "unknown" and obfuscated identifiers
+func parseHopIP(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	if len(hop) > 2 && hop[0] == '[' && hop[len(hop)-1] == ']' {
+		return net.ParseIP(hop[1 : len(hop)-1])
+	}
+	return nil
+}
+
+// parseTrustedCIDRs parses CIDRs and single IPs into prefixes
+// The "private_ranges" shorthand expands to all private and loopback networks
+func parseTrustedCIDRs(ranges []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, str := range ranges {
+		if str == "private_ranges" {
+			expanded, err := parseTrustedCIDRs(privateRanges)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, expanded...)
+			continue
+		}
+
+		if strings.Contains(str, "/") {
+			prefix, err := netip.ParsePrefix(str)
+			if err != nil {
+				return nil, fmt.Errorf("parsing CIDR expression '%s': %v", str, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address: '%s': %v", str, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,109 @@
+package geoip2
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLanguages is the language preference used for localized names if none is configured
+// German first as specified in nginx config, then English
+var DefaultLanguages = []string{"de", "en"}
+
+// localizedName selects a name from a MaxMind names map
+// The languages are tried in order, matching exactly, then case-insensitively, then by
+// base language (e.g. "pt" matches "pt-BR"); English follows as implicit fallback
+// If none matches, the name of the alphabetically first language is used so the
+// result does not depend on map iteration order
+func localizedName(names map[string]string, languages []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	for _, lang := range languages {
+		if name := names[lang]; name != "" {
+			return name
+		}
+	}
+
+	keys := make([]string, 0, len(names))
+	for key, name := range names {
+		if name != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, lang := range languages {
+		for _, key := range keys {
+			if strings.EqualFold(key, lang) {
+				return names[key]
+			}
+		}
+		for _, key := range keys {
+			base, _, _ := strings.Cut(key, "-")
+			if strings.EqualFold(base, lang) {
+				return names[key]
+			}
+		}
+	}
+
+	if name := names["en"]; name != "" {
+		return name
+	}
+	if len(keys) > 0 {
+		return names[keys[0]]
+	}
+	return ""
+}
+
+// parseAcceptLanguage returns the language tags of an Accept-Language header ordered by quality
+// Tags with a region (e.g. "pt-BR") are followed by their base language ("pt")
+// Example: "fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5" yields ["fr-CH", "fr", "en"]
+func parseAcceptLanguage(header string) []string {
+	type weightedTag struct {
+		tag     string
+		quality float64
+	}
+
+	var tags []weightedTag
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = v
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		tags = append(tags, weightedTag{tag, quality})
+	}
+
+	// Stable sort keeps the header order for equal qualities
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].quality > tags[j].quality
+	})
+
+	languages := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	add := func(lang string) {
+		if key := strings.ToLower(lang); !seen[key] {
+			seen[key] = true
+			languages = append(languages, lang)
+		}
+	}
+	for _, t := range tags {
+		add(t.tag)
+		if base, _, ok := strings.Cut(t.tag, "-"); ok {
+			add(base)
+		}
+	}
+	return languages
+}
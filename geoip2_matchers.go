@@ -0,0 +1,373 @@
+package geoip2
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// MatchCountry matches requests by the country of the client IP
+// It performs its own Country database lookup, so it works independently
+// of whether (or where) the geoip2_vars handler runs in the route
+//
+// Caddyfile usage:
+//
+//	@dach geoip2_country DE AT CH
+//	@not_dach not geoip2_country DE AT CH
+type MatchCountry struct {
+	// Countries is the list of ISO 3166-1 alpha-2 country codes to match
+	// Example: ["DE", "AT", "CH"]
+	Countries []string `json:"countries,omitempty"`
+
+	// countries is the normalized set of country codes, built once at provision time
+	countries map[string]struct{} `json:"-"`
+
+	// state holds reference to the shared GeoIP2 database state
+	state *GeoIP2State `json:"-"`
+}
+
+// MatchASN matches requests by the autonomous system of the client IP
+// ASNs can be given as single numbers or inclusive ranges, and organizations
+// as regular expressions matched against the AS organization name
+// A request matches if any number, range or organization pattern matches
+//
+// Caddyfile usage:
+//
+//	@hosting geoip2_asn 16509 14618 64512-65534
+//	@hosting geoip2_asn {
+//	  asn 16509 AS14618 64512-65534
+//	  org "(?i)hetzner" "(?i)digitalocean"
+//	}
+type MatchASN struct {
+	// ASNs is the list of AS numbers or ranges to match
+	// Example: ["16509", "AS14618", "64512-65534"]
+	ASNs []string `json:"asns,omitempty"`
+
+	// Organizations is the list of regular expressions matched against
+	// the AutonomousSystemOrganization field
+	// Example: ["(?i)amazon", "^Hetzner"]
+	Organizations []string `json:"organizations,omitempty"`
+
+	// ranges holds the parsed ASN ranges, built once at provision time
+	ranges []asnRange `json:"-"`
+
+	// organizations holds the compiled organization patterns
+	organizations []*regexp.Regexp `json:"-"`
+
+	// state holds reference to the shared GeoIP2 database state
+	state *GeoIP2State `json:"-"`
+}
+
+// asnRange is an inclusive range of AS numbers
+// Single AS numbers are represented with first == last
+type asnRange struct {
+	first uint64
+	last  uint64
+}
+
+// contains reports whether the AS number lies inside the range
+func (r asnRange) contains(asn uint64) bool {
+	return asn >= r.first && asn <= r.last
+}
+
+// asnRangesContain reports whether any of the ranges contains the AS number
+// ASN 0 means the database has no record and never matches
+func asnRangesContain(ranges []asnRange, asn uint64) bool {
+	if asn == 0 {
+		return false
+	}
+	for _, r := range ranges {
+		if r.contains(asn) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeCode normalizes a configured country or continent code for comparison
+// with the upper-case codes of the databases
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// codeSet compiles a list of country or continent codes into a lookup set
+func codeSet(codes []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(codes))
+	for _, code := range codes {
+		set[normalizeCode(code)] = struct{}{}
+	}
+	return set
+}
+
+// Module registration - called when Caddy starts
+func init() {
+	caddy.RegisterModule(MatchCountry{})
+	caddy.RegisterModule(MatchASN{})
+}
+
+// CaddyModule returns module information for Caddy's module system
+func (MatchCountry) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_country",
+		New: func() caddy.Module { return new(MatchCountry) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler
+// Parses: geoip2_country <code...>
+func (m *MatchCountry) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// Iterate to merge multiple matchers into one
+	for d.Next() {
+		for d.NextArg() {
+			m.Countries = append(m.Countries, d.Val())
+		}
+		if d.NextBlock(0) {
+			return d.Err("malformed geoip2_country matcher: blocks are not supported")
+		}
+	}
+	return nil
+}
+
+// Provision links the matcher to the shared GeoIP2 state and
+// compiles the country list into a lookup set
+func (m *MatchCountry) Provision(ctx caddy.Context) error {
+	app, err := ctx.App(moduleName)
+	if err != nil {
+		return fmt.Errorf("getting geoip2 app: %v", err)
+	}
+	m.state = app.(*GeoIP2State)
+
+	m.countries = codeSet(m.Countries)
+
+	return nil
+}
+
+// Validate checks if the configuration is valid
+func (m MatchCountry) Validate() error {
+	if len(m.Countries) == 0 {
+		return fmt.Errorf("geoip2_country matcher requires at least one country code")
+	}
+	for _, code := range m.Countries {
+		if len(strings.TrimSpace(code)) != 2 {
+			return fmt.Errorf("invalid country code '%s', must be a two-letter ISO code", code)
+		}
+	}
+	return nil
+}
+
+// Match returns true if the request's client IP resolves to one of the countries
+func (m MatchCountry) Match(r *http.Request) bool {
+	match, err := m.MatchWithError(r)
+	if err != nil {
+		caddyhttp.SetVar(r.Context(), caddyhttp.MatcherErrorVarKey, err)
+	}
+	return match
+}
+
+// MatchWithError returns true if the request's client IP resolves to one of the countries
+// Lookup failures are not treated as errors; the request simply does not match
+func (m MatchCountry) MatchWithError(r *http.Request) (bool, error) {
+	if m.state == nil {
+		return false, nil
+	}
+
+	clientIP, err := resolvedClientIP(r)
+	if err != nil {
+		caddy.Log().Named("http.matchers.geoip2_country").Debug("failed to get client IP",
+			zap.Error(err))
+		return false, nil
+	}
+
+	var countryRecord CountryRecord
+	if err := m.state.lookupCountryRecord(clientIP, &countryRecord); err != nil {
+		caddy.Log().Named("http.matchers.geoip2_country").Debug("Country lookup failed",
+			zap.String("ip", clientIP.String()),
+			zap.Error(err))
+		return false, nil
+	}
+
+	_, ok := m.countries[countryRecord.Country.ISOCode]
+	return ok, nil
+}
+
+// CaddyModule returns module information for Caddy's module system
+func (MatchASN) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_asn",
+		New: func() caddy.Module { return new(MatchASN) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler
+// Parses: geoip2_asn <asn|range...> or the block form with asn/org subdirectives
+func (m *MatchASN) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	// Iterate to merge multiple matchers into one
+	for d.Next() {
+		m.ASNs = append(m.ASNs, d.RemainingArgs()...)
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "asn":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.ASNs = append(m.ASNs, args...)
+
+			case "org":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.Organizations = append(m.Organizations, args...)
+
+			default:
+				return d.Errf("unknown subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Provision links the matcher to the shared GeoIP2 state and
+// compiles ASN ranges and organization patterns
+func (m *MatchASN) Provision(ctx caddy.Context) error {
+	app, err := ctx.App(moduleName)
+	if err != nil {
+		return fmt.Errorf("getting geoip2 app: %v", err)
+	}
+	m.state = app.(*GeoIP2State)
+
+	m.ranges = make([]asnRange, 0, len(m.ASNs))
+	for _, asn := range m.ASNs {
+		r, err := parseASNRange(asn)
+		if err != nil {
+			return err
+		}
+		m.ranges = append(m.ranges, r)
+	}
+
+	m.organizations = make([]*regexp.Regexp, 0, len(m.Organizations))
+	for _, pattern := range m.Organizations {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid organization pattern '%s': %v", pattern, err)
+		}
+		m.organizations = append(m.organizations, re)
+	}
+
+	return nil
+}
+
+// Validate checks if the configuration is valid
+func (m MatchASN) Validate() error {
+	if len(m.ASNs) == 0 && len(m.Organizations) == 0 {
+		return fmt.Errorf("geoip2_asn matcher requires at least one ASN, range or organization pattern")
+	}
+	return nil
+}
+
+// Match returns true if the request's client IP belongs to one of the configured autonomous systems
+func (m MatchASN) Match(r *http.Request) bool {
+	match, err := m.MatchWithError(r)
+	if err != nil {
+		caddyhttp.SetVar(r.Context(), caddyhttp.MatcherErrorVarKey, err)
+	}
+	return match
+}
+
+// MatchWithError returns true if the request's client IP belongs to one of the configured autonomous systems
+// Lookup failures are not treated as errors; the request simply does not match
+func (m MatchASN) MatchWithError(r *http.Request) (bool, error) {
+	if m.state == nil {
+		return false, nil
+	}
+
+	clientIP, err := resolvedClientIP(r)
+	if err != nil {
+		caddy.Log().Named("http.matchers.geoip2_asn").Debug("failed to get client IP",
+			zap.Error(err))
+		return false, nil
+	}
+
+	var asnRecord ASNRecord
+	if err := m.state.lookupASNRecord(clientIP, &asnRecord); err != nil {
+		caddy.Log().Named("http.matchers.geoip2_asn").Debug("ASN lookup failed",
+			zap.String("ip", clientIP.String()),
+			zap.Error(err))
+		return false, nil
+	}
+
+	return m.matchRecord(asnRecord), nil
+}
+
+// matchRecord checks an ASN record against the compiled ranges and patterns
+func (m MatchASN) matchRecord(record ASNRecord) bool {
+	if asnRangesContain(m.ranges, record.AutonomousSystemNumber) {
+		return true
+	}
+
+	if record.AutonomousSystemOrganization != "" {
+		for _, re := range m.organizations {
+			if re.MatchString(record.AutonomousSystemOrganization) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// parseASNRange parses a single AS number or an inclusive range
+// Supported formats: "13335", "AS13335", "64512-65534", "AS64512-AS65534"
+func parseASNRange(s string) (asnRange, error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		last = first
+	}
+
+	lo, err := parseASN(first)
+	if err != nil {
+		return asnRange{}, fmt.Errorf("invalid ASN '%s': %v", s, err)
+	}
+	hi, err := parseASN(last)
+	if err != nil {
+		return asnRange{}, fmt.Errorf("invalid ASN '%s': %v", s, err)
+	}
+	if lo > hi {
+		return asnRange{}, fmt.Errorf("invalid ASN range '%s': start is greater than end", s)
+	}
+
+	return asnRange{first: lo, last: hi}, nil
+}
+
+// parseASN parses an AS number with an optional "AS" prefix
+func parseASN(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	return strconv.ParseUint(s, 10, 32)
+}
+
+// Interface guards - compile-time checks that we implement required interfaces
+var (
+	_ caddy.Module                      = (*MatchCountry)(nil)
+	_ caddy.Provisioner                 = (*MatchCountry)(nil)
+	_ caddy.Validator                   = (*MatchCountry)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchCountry)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchCountry)(nil)
+
+	_ caddy.Module                      = (*MatchASN)(nil)
+	_ caddy.Provisioner                 = (*MatchASN)(nil)
+	_ caddy.Validator                   = (*MatchASN)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchASN)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchASN)(nil)
+)
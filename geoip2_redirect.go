@@ -0,0 +1,355 @@
+package geoip2
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// GeoIP2Redirect is an HTTP handler that redirects clients to a market-specific
+// URL based on their country or continent
+// Country mappings take precedence over continent mappings
+// Requests are passed on unchanged if the client opted out, belongs to a
+// skipped ASN (e.g. search engine crawlers) or is already on the target
+//
+// Caddyfile usage:
+//
+//	geoip2_redirect {
+//	  country DE AT https://shop.de{uri}
+//	  country CH https://shop.ch{uri}
+//	  continent NA https://shop.com{uri}
+//	  opt_out_query noredirect
+//	  opt_out_cookie geo_redirect
+//	  skip_asn 15169 8075
+//	}
+type GeoIP2Redirect struct {
+	// Countries maps ISO country codes to target URLs (placeholders supported)
+	// Example: {"DE": "https://shop.de{uri}"}
+	Countries map[string]string `json:"countries,omitempty"`
+
+	// Continents maps continent codes to target URLs (placeholders supported)
+	// Example: {"NA": "https://shop.com{uri}"}
+	Continents map[string]string `json:"continents,omitempty"`
+
+	// StatusCode is the redirect status code
+	// Default: 302
+	StatusCode int `json:"status_code,omitempty"`
+
+	// OptOutCookie is the name of a cookie that disables the redirect when present
+	// If OptOutQuery is also set, using the query parameter sets this cookie
+	OptOutCookie string `json:"opt_out_cookie,omitempty"`
+
+	// OptOutQuery is the name of a query parameter that disables the redirect when present
+	OptOutQuery string `json:"opt_out_query,omitempty"`
+
+	// SkipASNs is a list of AS numbers or ranges that are never redirected
+	// Typically used for search engine and monitoring crawlers
+	SkipASNs []string `json:"skip_asns,omitempty"`
+
+	// countries and continents are the normalized mappings, built once at provision time
+	countries  map[string]string `json:"-"`
+	continents map[string]string `json:"-"`
+
+	// skipRanges holds the parsed SkipASNs
+	skipRanges []asnRange `json:"-"`
+
+	// state holds reference to the shared GeoIP2 database state
+	state *GeoIP2State `json:"-"`
+}
+
+// Module registration - called when Caddy starts
+func init() {
+	caddy.RegisterModule(GeoIP2Redirect{})
+	httpcaddyfile.RegisterHandlerDirective("geoip2_redirect", parseRedirectCaddyfile)
+}
+
+// CaddyModule returns module information for Caddy's module system
+func (GeoIP2Redirect) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.geoip2_redirect",
+		New: func() caddy.Module { return new(GeoIP2Redirect) },
+	}
+}
+
+// parseRedirectCaddyfile parses the geoip2_redirect directive
+func parseRedirectCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var m GeoIP2Redirect
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return &m, err
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler
+// Parses the geoip2_redirect block:
+//
+//	country <code...> <target>
+//	continent <code...> <target>
+//	status <code>
+//	opt_out_cookie <name>
+//	opt_out_query <name>
+//	skip_asn <asn|range...>
+func (m *GeoIP2Redirect) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "country", "continent":
+				kind := d.Val()
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return d.ArgErr()
+				}
+				target := args[len(args)-1]
+				mapping := &m.Countries
+				if kind == "continent" {
+					mapping = &m.Continents
+				}
+				if *mapping == nil {
+					*mapping = make(map[string]string)
+				}
+				for _, code := range args[:len(args)-1] {
+					(*mapping)[code] = target
+				}
+
+			case "status":
+				var statusStr string
+				if !d.Args(&statusStr) {
+					return d.ArgErr()
+				}
+				status, err := strconv.Atoi(statusStr)
+				if err != nil {
+					return d.Errf("invalid status code '%s': %v", statusStr, err)
+				}
+				m.StatusCode = status
+
+			case "opt_out_cookie":
+				if !d.Args(&m.OptOutCookie) {
+					return d.ArgErr()
+				}
+
+			case "opt_out_query":
+				if !d.Args(&m.OptOutQuery) {
+					return d.ArgErr()
+				}
+
+			case "skip_asn":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				m.SkipASNs = append(m.SkipASNs, args...)
+
+			default:
+				return d.Errf("unknown subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Provision links the handler to the shared GeoIP2 state and compiles the mappings
+func (m *GeoIP2Redirect) Provision(ctx caddy.Context) error {
+	caddy.Log().Named("http.handlers.geoip2_redirect").Debug("provisioning GeoIP2 redirect handler")
+
+	app, err := ctx.App(moduleName)
+	if err != nil {
+		return fmt.Errorf("getting geoip2 app: %v", err)
+	}
+	m.state = app.(*GeoIP2State)
+
+	m.countries = make(map[string]string, len(m.Countries))
+	for code, target := range m.Countries {
+		m.countries[normalizeCode(code)] = target
+	}
+	m.continents = make(map[string]string, len(m.Continents))
+	for code, target := range m.Continents {
+		m.continents[normalizeCode(code)] = target
+	}
+
+	m.skipRanges = make([]asnRange, 0, len(m.SkipASNs))
+	for _, asn := range m.SkipASNs {
+		r, err := parseASNRange(asn)
+		if err != nil {
+			return err
+		}
+		m.skipRanges = append(m.skipRanges, r)
+	}
+
+	if m.StatusCode == 0 {
+		m.StatusCode = http.StatusFound
+	}
+
+	return nil
+}
+
+// Validate checks if the configuration is valid
+func (m GeoIP2Redirect) Validate() error {
+	if len(m.Countries) == 0 && len(m.Continents) == 0 {
+		return fmt.Errorf("geoip2_redirect requires at least one country or continent mapping")
+	}
+	if m.StatusCode < 300 || m.StatusCode > 399 {
+		return fmt.Errorf("invalid status_code %d, must be a 3xx redirect status", m.StatusCode)
+	}
+	return nil
+}
+
+// ServeHTTP implements the HTTP middleware interface
+func (m *GeoIP2Redirect) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if m.state == nil {
+		caddy.Log().Named("http.handlers.geoip2_redirect").Warn("GeoIP2 state not available")
+		return next.ServeHTTP(w, r)
+	}
+
+	if m.optedOut(w, r) {
+		return next.ServeHTTP(w, r)
+	}
+
+	result, err := requestLookupResult(m.state, r)
+	if err != nil {
+		caddy.Log().Named("http.handlers.geoip2_redirect").Debug("failed to get client IP",
+			zap.Error(err))
+		return next.ServeHTTP(w, r)
+	}
+
+	if m.skipASN(result.ASN) {
+		return next.ServeHTTP(w, r)
+	}
+
+	// Country mapping takes precedence over continent mapping
+	template, ok := m.countries[result.CountryCode]
+	if !ok || result.CountryCode == "" {
+		template, ok = m.continents[result.ContinentCode]
+		if !ok || result.ContinentCode == "" {
+			return next.ServeHTTP(w, r)
+		}
+	}
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	target := repl.ReplaceKnown(template, "")
+
+	if alreadyOnTarget(r, template, target) {
+		return next.ServeHTTP(w, r)
+	}
+
+	caddy.Log().Named("http.handlers.geoip2_redirect").Debug("redirecting request",
+		zap.String("ip", result.IP.String()),
+		zap.String("country", result.CountryCode),
+		zap.String("continent", result.ContinentCode),
+		zap.String("target", target))
+
+	// Location-dependent responses must not be shared by caches
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Location", target)
+	w.WriteHeader(m.StatusCode)
+	return nil
+}
+
+// optedOut reports whether the client opted out of the redirect
+// A present opt-out query parameter also sets the opt-out cookie, if configured
+func (m *GeoIP2Redirect) optedOut(w http.ResponseWriter, r *http.Request) bool {
+	if m.OptOutQuery != "" && r.URL.Query().Has(m.OptOutQuery) {
+		if m.OptOutCookie != "" {
+			http.SetCookie(w, &http.Cookie{
+				Name:     m.OptOutCookie,
+				Value:    "1",
+				Path:     "/",
+				MaxAge:   365 * 24 * 60 * 60,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		return true
+	}
+
+	if m.OptOutCookie != "" {
+		if cookie, err := r.Cookie(m.OptOutCookie); err == nil && cookie.Value != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skipASN reports whether the ASN is in the configured skip list
+func (m *GeoIP2Redirect) skipASN(asn uint64) bool {
+	return asnRangesContain(m.skipRanges, asn)
+}
+
+// alreadyOnTarget detects redirect loops by checking whether the request is already served by the target
+// Absolute targets must match the host; the path is then compared against the literal path
+// prefix of the template (the part before the first placeholder) on a segment boundary
+func alreadyOnTarget(r *http.Request, template, target string) bool {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		// An unparsable target cannot be redirected to safely
+		return true
+	}
+
+	if targetURL.Host != "" && !strings.EqualFold(stripPort(targetURL.Host), stripPort(r.Host)) {
+		return false
+	}
+
+	if targetURL.RequestURI() == r.URL.RequestURI() {
+		return true
+	}
+
+	prefix := templatePath(template)
+	if i := strings.IndexByte(prefix, '{'); i >= 0 {
+		prefix = prefix[:i]
+	}
+	if i := strings.IndexByte(prefix, '?'); i >= 0 {
+		prefix = prefix[:i]
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		// A target at the root of the host serves every path
+		return targetURL.Host != ""
+	}
+	return r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")
+}
+
+// templatePath returns the path part of a redirect template
+// The host of an absolute template may itself be a placeholder (e.g. "https://{host}/de{uri}"),
+// so the template is split textually instead of being parsed as a URL
+func templatePath(template string) string {
+	scheme, rest, ok := strings.Cut(template, "://")
+	if !ok || strings.ContainsAny(scheme, "/?") {
+		if rest, ok = strings.CutPrefix(template, "//"); !ok {
+			// Relative template
+			return template
+		}
+	}
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		return rest[i:]
+	}
+	return ""
+}
+
+// stripPort removes an optional port from a host
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// Interface guards - compile-time checks that we implement required interfaces
+var (
+	_ caddy.Module                = (*GeoIP2Redirect)(nil)
+	_ caddy.Provisioner           = (*GeoIP2Redirect)(nil)
+	_ caddy.Validator             = (*GeoIP2Redirect)(nil)
+	_ caddyhttp.MiddlewareHandler = (*GeoIP2Redirect)(nil)
+	_ caddyfile.Unmarshaler       = (*GeoIP2Redirect)(nil)
+)
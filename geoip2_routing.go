@@ -0,0 +1,204 @@
+package geoip2
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// CityRoute routes City lookups to a named database based on the Country lookup result
+// A route matches if any of its criteria matches; routes are evaluated in order
+// and all matching databases are consulted until one has city data
+type CityRoute struct {
+	// Countries is a list of ISO country codes
+	Countries []string `json:"countries,omitempty"`
+
+	// Continents is a list of continent codes (AF, AN, AS, EU, NA, OC, SA)
+	Continents []string `json:"continents,omitempty"`
+
+	// InEU matches on EU membership if set (true = EU members, false = non-members)
+	InEU *bool `json:"in_eu,omitempty"`
+
+	// Database is the name of the city database to use
+	Database string `json:"database"`
+
+	// countries and continents are built once at provision time
+	countries  map[string]struct{} `json:"-"`
+	continents map[string]struct{} `json:"-"`
+}
+
+// parseCityRoute parses the arguments of a route line:
+//
+//	route country <codes...> -> <database>
+//	route continent <codes...> -> <database>
+//	route eu|non_eu -> <database>
+//
+// The "->" separator is optional
+func parseCityRoute(d *caddyfile.Dispenser) (*CityRoute, error) {
+	args := d.RemainingArgs()
+	if len(args) >= 2 && args[len(args)-2] == "->" {
+		args = append(args[:len(args)-2], args[len(args)-1])
+	}
+	if len(args) < 2 {
+		return nil, d.ArgErr()
+	}
+
+	route := &CityRoute{Database: args[len(args)-1]}
+	values := args[1 : len(args)-1]
+
+	switch args[0] {
+	case "country":
+		if len(values) == 0 {
+			return nil, d.ArgErr()
+		}
+		route.Countries = values
+	case "continent":
+		if len(values) == 0 {
+			return nil, d.ArgErr()
+		}
+		route.Continents = values
+	case "eu", "non_eu":
+		if len(values) != 0 {
+			return nil, d.ArgErr()
+		}
+		inEU := args[0] == "eu"
+		route.InEU = &inEU
+	default:
+		return nil, d.Errf("unknown route criterion: %s", args[0])
+	}
+
+	return route, nil
+}
+
+// parseDefaultCityDatabase parses the arguments of a default line: default [->] <database>
+func parseDefaultCityDatabase(d *caddyfile.Dispenser) (string, error) {
+	args := d.RemainingArgs()
+	if len(args) == 2 && args[0] == "->" {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return "", d.ArgErr()
+	}
+	return args[0], nil
+}
+
+// provision compiles the route's criteria into lookup sets
+func (route *CityRoute) provision() {
+	route.countries = codeSet(route.Countries)
+	route.continents = codeSet(route.Continents)
+}
+
+// matches reports whether any of the route's criteria matches the country lookup result
+func (route *CityRoute) matches(countryCode, continentCode string, isInEU bool) bool {
+	if countryCode != "" {
+		if _, ok := route.countries[countryCode]; ok {
+			return true
+		}
+	}
+	if continentCode != "" {
+		if _, ok := route.continents[continentCode]; ok {
+			return true
+		}
+	}
+	// EU membership is only meaningful if the country lookup succeeded
+	return route.InEU != nil && countryCode != "" && *route.InEU == isInEU
+}
+
+// validateCityRoutes checks that all routes are complete and reference configured databases
+func (g GeoIP2State) validateCityRoutes() error {
+	for i, route := range g.CityRoutes {
+		if len(route.Countries) == 0 && len(route.Continents) == 0 && route.InEU == nil {
+			return fmt.Errorf("city route %d: at least one criterion is required", i)
+		}
+		if _, ok := g.dbConfigs[route.Database]; !ok {
+			return fmt.Errorf("city route %d: unknown database '%s'", i, route.Database)
+		}
+	}
+	if g.DefaultCityDatabase != "" {
+		if _, ok := g.dbConfigs[g.DefaultCityDatabase]; !ok {
+			return fmt.Errorf("unknown default city database '%s'", g.DefaultCityDatabase)
+		}
+	}
+	return nil
+}
+
+// cityDatabasesFor returns the loaded city databases to consult for a Country lookup result, in order
+// Without routing rules, EU IPs use the Europe-specific database with the global database
+// as fallback, all other IPs use the global database
+func (g *GeoIP2State) cityDatabasesFor(countryCode, continentCode string, isInEU bool) []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] && g.HasDatabase(name) {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	if len(g.CityRoutes) == 0 && g.DefaultCityDatabase == "" {
+		if isInEU {
+			add(DatabaseCity)
+		}
+		add(DatabaseGlobalCity)
+		return names
+	}
+
+	for _, route := range g.CityRoutes {
+		if route.matches(countryCode, continentCode, isInEU) {
+			add(route.Database)
+		}
+	}
+	add(g.DefaultCityDatabase)
+
+	return names
+}
+
+// lookupCity performs the City lookup in the routed databases
+// If a database has no record or the record has no city names, the next database is consulted;
+// if none has city names, the first record with location data is kept so that it is not lost
+// Returns the name of the database whose record was used, empty if no database had data,
+// and the network the record applies to
+func (g *GeoIP2State) lookupCity(ip net.IP, countryCode, continentCode string, isInEU bool, record *CityRecord) (string, netip.Prefix, error) {
+	var (
+		first        *CityRecord
+		firstName    string
+		firstNetwork netip.Prefix
+		lastName     string
+		lastErr      error
+	)
+
+	for _, name := range g.cityDatabasesFor(countryCode, continentCode, isInEU) {
+		var candidate CityRecord
+		network, err := g.LookupNetworkIn(name, ip, &candidate)
+		if err != nil {
+			lastName, lastErr = name, err
+			continue
+		}
+		if candidate.hasCityNames() {
+			*record = candidate
+			return name, network, nil
+		}
+		if first == nil && candidate.hasLocation() {
+			first, firstName, firstNetwork = &candidate, name, network
+		}
+	}
+
+	if first != nil {
+		*record = *first
+		return firstName, firstNetwork, nil
+	}
+	return lastName, netip.Prefix{}, lastErr
+}
+
+// hasCityNames reports whether the record names a city
+func (record *CityRecord) hasCityNames() bool {
+	return len(record.City.Names) > 0
+}
+
+// hasLocation reports whether the record has coordinates
+// 0,0 is what an absent location decodes to
+func (record *CityRecord) hasLocation() bool {
+	return record.Location.Latitude != 0 || record.Location.Longitude != 0
+}
@@ -0,0 +1,156 @@
+package geoip2
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+// databaseSnapshot is an immutable set of open database readers
+// Lookups hold a reference while they use a snapshot; once a snapshot has been replaced
+// and its last reference is released, the readers it no longer shares with its
+// successor are closed
+type databaseSnapshot struct {
+	// readers holds the open database readers by name, never modified after creation
+	readers map[string]*maxminddb.Reader
+
+	// generation identifies the snapshot, so cached results of replaced snapshots are not served
+	generation uint64
+
+	// refs counts the owning store (1) plus all lookups in progress; 0 = closed
+	refs atomic.Int64
+
+	// retired holds the readers to close on the last release, set when the snapshot is replaced
+	retired []string
+}
+
+// errStoreClosed is returned by reloads that finish after the app has been stopped
+var errStoreClosed = errors.New("databases are closed")
+
+// snapshotStore publishes the current database snapshot
+// Lookups load it with a single atomic read and never block; reloads open the new
+// databases without holding any lock and swap the snapshot in one atomic store
+type snapshotStore struct {
+	current atomic.Pointer[databaseSnapshot]
+
+	// swapMutex serializes reloads, so concurrent reloads of different databases don't
+	// lose each other's readers; lookups never take it
+	swapMutex sync.Mutex
+
+	// generations counts the snapshots created so far
+	generations uint64
+
+	// closed is set once the store is closed; later reloads are rejected so that
+	// a reload finishing after shutdown doesn't publish readers nobody closes
+	closed bool
+}
+
+// newSnapshotStore creates an empty store
+func newSnapshotStore() *snapshotStore {
+	return &snapshotStore{}
+}
+
+// acquire returns the current snapshot with a reference held, or nil if none is loaded
+// The caller must release the snapshot when done
+func (s *snapshotStore) acquire() *databaseSnapshot {
+	for {
+		snap := s.current.Load()
+		if snap == nil {
+			return nil
+		}
+		refs := snap.refs.Load()
+		if refs <= 0 {
+			// Replaced and drained in the meantime, its successor is already published
+			continue
+		}
+		if snap.refs.CompareAndSwap(refs, refs+1) {
+			return snap
+		}
+	}
+}
+
+// load returns the current snapshot without holding a reference
+// Only for inspecting the set of loaded databases, not for using the readers
+func (s *snapshotStore) load() *databaseSnapshot {
+	return s.current.Load()
+}
+
+// update replaces the current snapshot with the readers returned by build
+// build receives the readers of the current snapshot (nil if none) and must not modify them;
+// it is called with reloads serialized, so it should only check and assemble already
+// opened readers. If build fails, the current snapshot stays in place
+func (s *snapshotStore) update(build func(current map[string]*maxminddb.Reader) (map[string]*maxminddb.Reader, error)) error {
+	s.swapMutex.Lock()
+	defer s.swapMutex.Unlock()
+
+	if s.closed {
+		return errStoreClosed
+	}
+
+	old := s.current.Load()
+	var current map[string]*maxminddb.Reader
+	if old != nil {
+		current = old.readers
+	}
+
+	readers, err := build(current)
+	if err != nil {
+		return err
+	}
+
+	var next *databaseSnapshot
+	if readers != nil {
+		s.generations++
+		next = &databaseSnapshot{readers: readers, generation: s.generations}
+		next.refs.Store(1)
+	}
+	s.current.Store(next)
+
+	if old != nil {
+		old.retire(next)
+		old.release()
+	}
+	return nil
+}
+
+// close unpublishes the current snapshot; its readers are closed once all lookups are done
+func (s *snapshotStore) close() {
+	s.swapMutex.Lock()
+	defer s.swapMutex.Unlock()
+
+	s.closed = true
+	if old := s.current.Swap(nil); old != nil {
+		old.retire(nil)
+		old.release()
+	}
+}
+
+// retire records which readers are not carried over to the successor snapshot
+// Must be called before the store's reference is released
+func (snap *databaseSnapshot) retire(next *databaseSnapshot) {
+	for name, reader := range snap.readers {
+		if next == nil || next.readers[name] != reader {
+			snap.retired = append(snap.retired, name)
+		}
+	}
+}
+
+// release drops a reference and closes the retired readers when the last one is gone
+func (snap *databaseSnapshot) release() {
+	if snap.refs.Add(-1) != 0 {
+		return
+	}
+	for _, name := range snap.retired {
+		if err := snap.readers[name].Close(); err != nil {
+			caddy.Log().Named("geoip2").Warn("error closing old database",
+				zap.String("database", name),
+				zap.Error(err))
+		}
+		caddy.Log().Named("geoip2").Debug("closed database",
+			zap.String("database", name))
+	}
+}
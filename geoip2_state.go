@@ -5,10 +5,11 @@ import (
 	"fmt"
 	"io/fs"
 	"net"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -21,66 +22,152 @@ import (
 
 // GeoIP2State manages the shared GeoIP2 database state across all handler instances
 // This is a Caddy app that provides centralized database management with features like:
-// - Thread-safe database access
-// - Automatic database reloading
+// - Lock-free database access, databases are swapped atomically on reload
+// - Automatic database reloading, configurable per database
 // - Shared state across multiple handler instances
-// - Support for multiple specialized databases with intelligent routing
+// - A registry of arbitrarily named databases (Country, City, ASN, Anonymous-IP, ISP, custom)
 // - Performance optimization: EU IPs use Europe-specific database, others use global database
 type GeoIP2State struct {
-	// CountryDBHandler is the MaxMind Country database reader instance
-	// Used for country code and EU status lookups
-	CountryDBHandler *maxminddb.Reader `json:"-"`
-
-	// CityDBHandler is the MaxMind City database reader instance (Europe-focused)
-	// Used for city names, subdivisions, and geographic coordinates for European IPs
-	CityDBHandler *maxminddb.Reader `json:"-"`
-
-	// GlobalCityDBHandler is the global MaxMind City database reader instance
-	// Used for city data for non-European IPs as fallback
-	GlobalCityDBHandler *maxminddb.Reader `json:"-"`
-
-	// ASNDBHandler is the MaxMind ASN database reader instance
-	// Used for ASN number and organization lookups
-	ASNDBHandler *maxminddb.Reader `json:"-"`
-
-	// mutex protects concurrent access to all database handlers
-	mutex *sync.RWMutex `json:"-"`
+	// Databases is the registry of named MaxMind databases
+	// The names "country", "city", "global_city", "asn", "anonymous_ip", "isp",
+	// "connection_type" and "enterprise" are used by the
+	// geoip2_vars handler; any other name can be queried with LookupIn
+	Databases map[string]*DatabaseConfig `json:"databases,omitempty"`
 
 	// CountryDatabasePath is the filesystem path to the Country database file
+	// Shorthand for the "country" entry in Databases
 	// Example: "/etc/nginx/maxmind-geo-ip/GeoIP-Country/GeoIP2-Country.mmdb"
 	CountryDatabasePath string `json:"country_database_path,omitempty"`
 
 	// CityDatabasePath is the filesystem path to the Europe-focused City database file
+	// Shorthand for the "city" entry in Databases
 	// Example: "/etc/nginx/maxmind-geo-ip/GeoIP-Country/GeoIP2-City-Europe.mmdb"
 	CityDatabasePath string `json:"city_database_path,omitempty"`
 
 	// GlobalCityDatabasePath is the filesystem path to the global City database file
+	// Shorthand for the optional "global_city" entry in Databases
 	// Example: "/etc/nginx/maxmind-geo-ip/GeoLite2-City.mmdb"
 	// Used as fallback for non-European IPs
 	GlobalCityDatabasePath string `json:"global_city_database_path,omitempty"`
 
 	// ASNDatabasePath is the filesystem path to the ASN database file
+	// Shorthand for the optional "asn" entry in Databases
 	// Example: "/etc/nginx/maxmind-geo-ip/GeoLite2-ASN.mmdb"
 	ASNDatabasePath string `json:"asn_database_path,omitempty"`
 
+	// AnonymousIPDatabasePath is the filesystem path to the Anonymous IP database file
+	// Shorthand for the optional "anonymous_ip" entry in Databases
+	// Example: "/etc/nginx/maxmind-geo-ip/GeoIP2-Anonymous-IP.mmdb"
+	AnonymousIPDatabasePath string `json:"anonymous_ip_database_path,omitempty"`
+
+	// ISPDatabasePath is the filesystem path to the ISP database file
+	// Shorthand for the optional "isp" entry in Databases
+	// Example: "/etc/nginx/maxmind-geo-ip/GeoIP2-ISP.mmdb"
+	ISPDatabasePath string `json:"isp_database_path,omitempty"`
+
+	// ConnectionTypeDatabasePath is the filesystem path to the Connection-Type database file
+	// Shorthand for the optional "connection_type" entry in Databases
+	// Example: "/etc/nginx/maxmind-geo-ip/GeoIP2-Connection-Type.mmdb"
+	ConnectionTypeDatabasePath string `json:"connection_type_database_path,omitempty"`
+
+	// EnterpriseDatabasePath is the filesystem path to the Enterprise database file
+	// Shorthand for the "enterprise" entry in Databases
+	// If set, this single database answers the Country, City, ASN, ISP and Connection-Type
+	// lookups, and the default country and city database paths are not used
+	// Example: "/etc/nginx/maxmind-geo-ip/GeoIP2-Enterprise.mmdb"
+	EnterpriseDatabasePath string `json:"enterprise_database_path,omitempty"`
+
+	// CityRoutes select the city databases based on the Country lookup result
+	// Example: continent NA -> "city_na", country CH -> "city"
+	// Without routes, EU IPs use "city" and all other IPs use "global_city"
+	CityRoutes []*CityRoute `json:"city_routes,omitempty"`
+
+	// DefaultCityDatabase is consulted after all matching city routes
+	// Example: "global_city"
+	DefaultCityDatabase string `json:"default_city_database,omitempty"`
+
+	// Languages is the preference list for localized names (city, continent, subdivisions)
+	// Handlers can override it; default: ["de", "en"]
+	Languages []string `json:"languages,omitempty"`
+
+	// Cache enables an in-process LRU cache of lookup results
+	// nil = no caching
+	Cache *CacheConfig `json:"cache,omitempty"`
+
+	// Watch enables reloading a database as soon as its file changes on disk (Linux only)
+	// nil = files are only reloaded by the reload timers
+	Watch *WatchConfig `json:"watch,omitempty"`
+
 	// ReloadInterval specifies how often to reload the databases (in hours)
+	// Applies to all databases that don't set their own reload interval
 	// 0 = no automatic reloading, manual reload via caddy admin API only
 	ReloadInterval int `json:"reload_interval,omitempty"`
 
-	// done channel signals the reload timer goroutine to stop
+	// dbConfigs is the effective database registry: Databases merged with the path shorthands
+	dbConfigs map[string]*DatabaseConfig `json:"-"`
+
+	// databases holds the current snapshot of open database readers
+	databases *snapshotStore `json:"-"`
+
+	// cache holds decoded lookup results if Cache is configured
+	cache *lookupCache `json:"-"`
+
+	// watcher reloads databases whose files changed if Watch is configured
+	watcher *databaseWatcher `json:"-"`
+
+	// done channel signals the reload timer goroutines to stop
 	done chan bool `json:"-"`
 }
 
+// DatabaseConfig configures a single named MaxMind database
+type DatabaseConfig struct {
+	// Path is the filesystem path to the .mmdb file
+	Path string `json:"path"`
+
+	// ReloadInterval specifies how often to reload this database (in hours)
+	// Unset = use the app's reload_interval, 0 = no automatic reloading
+	ReloadInterval *int `json:"reload_interval,omitempty"`
+
+	// Optional databases that fail to load only log a warning; their lookups return errors
+	// Required databases (the default) fail startup and keep the previous version on reload
+	Optional bool `json:"optional,omitempty"`
+}
+
 // Module name for Caddy's app registry
 const (
 	moduleName = "geoip2"
 )
 
+// Well-known database names used by the geoip2_vars handler
+const (
+	DatabaseCountry        = "country"
+	DatabaseCity           = "city"
+	DatabaseGlobalCity     = "global_city"
+	DatabaseASN            = "asn"
+	DatabaseAnonymousIP    = "anonymous_ip"
+	DatabaseISP            = "isp"
+	DatabaseConnectionType = "connection_type"
+	DatabaseEnterprise     = "enterprise"
+)
+
 // Default configuration values
 const (
 	DefaultReloadHours = 24 // Daily reload by default
 )
 
+// knownDatabaseTypes lists the expected MaxMind database types for well-known names
+// Used to warn about misconfigured paths
+var knownDatabaseTypes = map[string][]string{
+	DatabaseCountry:        {"GeoLite2-Country", "GeoIP2-Country"},
+	DatabaseCity:           {"GeoLite2-City", "GeoIP2-City", "GeoIP2-City-Europe"},
+	DatabaseGlobalCity:     {"GeoLite2-City", "GeoIP2-City", "GeoIP2-City-Europe"},
+	DatabaseASN:            {"GeoLite2-ASN", "GeoIP2-ASN"},
+	DatabaseAnonymousIP:    {"GeoIP2-Anonymous-IP"},
+	DatabaseISP:            {"GeoIP2-ISP"},
+	DatabaseConnectionType: {"GeoIP2-Connection-Type"},
+	DatabaseEnterprise:     {"GeoIP2-Enterprise"},
+}
+
 // Module registration - called when Caddy starts
 func init() {
 	caddy.RegisterModule(GeoIP2State{})
@@ -109,26 +196,42 @@ func parseGeoip2(d *caddyfile.Dispenser, _ any) (any, error) {
 // Start initializes the GeoIP2 app when Caddy starts
 // This method is called once when the server starts up
 func (g *GeoIP2State) Start() error {
-	// Initialize mutex if not already done
-	if g.mutex == nil {
-		g.mutex = &sync.RWMutex{}
+	// Initialize the snapshot store if not already done
+	if g.databases == nil {
+		g.databases = newSnapshotStore()
 	}
 
-	caddy.Log().Named("geoip2").Info("starting GeoIP2 module",
-		zap.String("country_database_path", g.CountryDatabasePath),
-		zap.String("city_database_path", g.CityDatabasePath),
-		zap.String("global_city_database_path", g.GlobalCityDatabasePath),
-		zap.String("asn_database_path", g.ASNDatabasePath),
-		zap.String("reload_interval", fmt.Sprintf("%dh", g.ReloadInterval)))
+	for _, name := range g.databaseNames() {
+		caddy.Log().Named("geoip2").Info("starting GeoIP2 module",
+			zap.String("database", name),
+			zap.String("path", g.dbConfigs[name].Path),
+			zap.String("reload_interval", fmt.Sprintf("%dh", g.reloadIntervalFor(name))))
+	}
 
-	// Load database for the first time
+	// Load databases for the first time
 	if err := g.loadDatabase(); err != nil {
 		return fmt.Errorf("failed to load initial database: %v", err)
 	}
 
-	// Start automatic reload timer if configured
-	if g.ReloadInterval > 0 {
-		g.startReloadTimer()
+	// Start automatic reload timers if configured, one per interval so that
+	// databases sharing an interval are reloaded together
+	g.done = make(chan bool, 1)
+	groups := g.reloadGroups()
+	intervals := make([]int, 0, len(groups))
+	for hours := range groups {
+		intervals = append(intervals, hours)
+	}
+	sort.Ints(intervals)
+	for _, hours := range intervals {
+		g.startReloadTimer(groups[hours], hours)
+	}
+
+	// Watching is an addition to the reload timers, so failing to set it up is not fatal
+	if g.Watch != nil {
+		if err := g.startFileWatcher(); err != nil {
+			caddy.Log().Named("geoip2").Warn("failed to watch database files, relying on the reload timers",
+				zap.Error(err))
+		}
 	}
 
 	return nil
@@ -137,47 +240,24 @@ func (g *GeoIP2State) Start() error {
 // Stop cleanly shuts down the GeoIP2 app when Caddy stops
 // This method is called when the server is shutting down
 func (g *GeoIP2State) Stop() error {
-	// Stop the reload timer if running
+	// Stop the reload timers if running
 	if g.done != nil {
 		close(g.done)
-		caddy.Log().Named("geoip2").Debug("stopped reload timer")
+		caddy.Log().Named("geoip2").Debug("stopped reload timers")
 	}
 
-	// Close database connection
-	g.mutex.Lock()
-	defer g.mutex.Unlock()
-
-	if g.CountryDBHandler != nil {
-		if err := g.CountryDBHandler.Close(); err != nil {
-			caddy.Log().Named("geoip2").Warn("error closing country database",
+	// Stop watching the database files
+	if g.watcher != nil {
+		if err := g.watcher.stop(); err != nil {
+			caddy.Log().Named("geoip2").Warn("error closing file watcher",
 				zap.Error(err))
 		}
-		g.CountryDBHandler = nil
-		caddy.Log().Named("geoip2").Debug("closed country database")
+		caddy.Log().Named("geoip2").Debug("stopped watching database files")
 	}
-	if g.CityDBHandler != nil {
-		if err := g.CityDBHandler.Close(); err != nil {
-			caddy.Log().Named("geoip2").Warn("error closing city database",
-				zap.Error(err))
-		}
-		g.CityDBHandler = nil
-		caddy.Log().Named("geoip2").Debug("closed city database")
-	}
-	if g.GlobalCityDBHandler != nil {
-		if err := g.GlobalCityDBHandler.Close(); err != nil {
-			caddy.Log().Named("geoip2").Warn("error closing global city database",
-				zap.Error(err))
-		}
-		g.GlobalCityDBHandler = nil
-		caddy.Log().Named("geoip2").Debug("closed global city database")
-	}
-	if g.ASNDBHandler != nil {
-		if err := g.ASNDBHandler.Close(); err != nil {
-			caddy.Log().Named("geoip2").Warn("error closing ASN database",
-				zap.Error(err))
-		}
-		g.ASNDBHandler = nil
-		caddy.Log().Named("geoip2").Debug("closed ASN database")
+
+	// Close database connections once in-flight lookups are done
+	if g.databases != nil {
+		g.databases.close()
 	}
 
 	caddy.Log().Named("geoip2").Info("stopped GeoIP2 module")
@@ -192,14 +272,29 @@ func (g *GeoIP2State) Stop() error {
 //	  city_database_path /path/to/city-europe.mmdb
 //	  global_city_database_path /path/to/city-global.mmdb
 //	  asn_database_path /path/to/asn.mmdb  # optional
+//	  anonymous_ip_database_path /path/to/anonymous-ip.mmdb  # optional
+//	  isp_database_path /path/to/isp.mmdb  # optional
+//	  connection_type_database_path /path/to/connection-type.mmdb  # optional
+//	  enterprise_database_path /path/to/enterprise.mmdb  # replaces country, city, asn, isp and connection type
+//	  database anonymous_ip /path/to/anonymous-ip.mmdb {
+//	    reload_interval weekly
+//	    optional
+//	  }
+//	  route continent NA -> city_na
+//	  route eu -> city
+//	  default -> global_city
+//	  languages en fr de
+//	  cache {
+//	    size 100000
+//	    ttl 10m
+//	    shards 16
+//	  }
+//	  watch {
+//	    debounce 5s
+//	  }
 //	  reload_interval daily
 //	}
 func (g *GeoIP2State) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	// Initialize mutex early for thread safety
-	if g.mutex == nil {
-		g.mutex = &sync.RWMutex{}
-	}
-
 	for d.Next() {
 		for d.NextBlock(0) {
 			switch d.Val() {
@@ -207,40 +302,171 @@ func (g *GeoIP2State) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if !d.Args(&g.CountryDatabasePath) {
 					return d.ArgErr()
 				}
-				// Expand environment variables and resolve relative paths
-				g.CountryDatabasePath = os.ExpandEnv(g.CountryDatabasePath)
-				if !filepath.IsAbs(g.CountryDatabasePath) {
-					g.CountryDatabasePath, _ = filepath.Abs(g.CountryDatabasePath)
-				}
+				g.CountryDatabasePath = expandDatabasePath(g.CountryDatabasePath)
 
 			case "city_database_path":
 				if !d.Args(&g.CityDatabasePath) {
 					return d.ArgErr()
 				}
-				// Expand environment variables and resolve relative paths
-				g.CityDatabasePath = os.ExpandEnv(g.CityDatabasePath)
-				if !filepath.IsAbs(g.CityDatabasePath) {
-					g.CityDatabasePath, _ = filepath.Abs(g.CityDatabasePath)
-				}
+				g.CityDatabasePath = expandDatabasePath(g.CityDatabasePath)
 
 			case "global_city_database_path":
 				if !d.Args(&g.GlobalCityDatabasePath) {
 					return d.ArgErr()
 				}
-				// Expand environment variables and resolve relative paths
-				g.GlobalCityDatabasePath = os.ExpandEnv(g.GlobalCityDatabasePath)
-				if !filepath.IsAbs(g.GlobalCityDatabasePath) {
-					g.GlobalCityDatabasePath, _ = filepath.Abs(g.GlobalCityDatabasePath)
-				}
+				g.GlobalCityDatabasePath = expandDatabasePath(g.GlobalCityDatabasePath)
 
 			case "asn_database_path":
 				if !d.Args(&g.ASNDatabasePath) {
 					return d.ArgErr()
 				}
-				// Expand environment variables and resolve relative paths
-				g.ASNDatabasePath = os.ExpandEnv(g.ASNDatabasePath)
-				if !filepath.IsAbs(g.ASNDatabasePath) {
-					g.ASNDatabasePath, _ = filepath.Abs(g.ASNDatabasePath)
+				g.ASNDatabasePath = expandDatabasePath(g.ASNDatabasePath)
+
+			case "anonymous_ip_database_path":
+				if !d.Args(&g.AnonymousIPDatabasePath) {
+					return d.ArgErr()
+				}
+				g.AnonymousIPDatabasePath = expandDatabasePath(g.AnonymousIPDatabasePath)
+
+			case "isp_database_path":
+				if !d.Args(&g.ISPDatabasePath) {
+					return d.ArgErr()
+				}
+				g.ISPDatabasePath = expandDatabasePath(g.ISPDatabasePath)
+
+			case "connection_type_database_path":
+				if !d.Args(&g.ConnectionTypeDatabasePath) {
+					return d.ArgErr()
+				}
+				g.ConnectionTypeDatabasePath = expandDatabasePath(g.ConnectionTypeDatabasePath)
+
+			case "enterprise_database_path":
+				if !d.Args(&g.EnterpriseDatabasePath) {
+					return d.ArgErr()
+				}
+				g.EnterpriseDatabasePath = expandDatabasePath(g.EnterpriseDatabasePath)
+
+			case "database":
+				var name string
+				db := &DatabaseConfig{}
+				if !d.Args(&name, &db.Path) {
+					return d.ArgErr()
+				}
+				db.Path = expandDatabasePath(db.Path)
+
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "reload_interval":
+						var intervalStr string
+						if !d.Args(&intervalStr) {
+							return d.ArgErr()
+						}
+						interval, err := g.parseReloadInterval(intervalStr)
+						if err != nil {
+							return d.Errf("invalid reload_interval '%s': %v", intervalStr, err)
+						}
+						db.ReloadInterval = &interval
+
+					case "optional":
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+						db.Optional = true
+
+					default:
+						return d.Errf("unknown database subdirective: %s", d.Val())
+					}
+				}
+
+				if g.Databases == nil {
+					g.Databases = make(map[string]*DatabaseConfig)
+				}
+				if _, exists := g.Databases[name]; exists {
+					return d.Errf("database '%s' is already defined", name)
+				}
+				g.Databases[name] = db
+
+			case "route":
+				route, err := parseCityRoute(d)
+				if err != nil {
+					return err
+				}
+				g.CityRoutes = append(g.CityRoutes, route)
+
+			case "default":
+				name, err := parseDefaultCityDatabase(d)
+				if err != nil {
+					return err
+				}
+				g.DefaultCityDatabase = name
+
+			case "languages":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				g.Languages = append(g.Languages, args...)
+
+			case "cache":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				g.Cache = &CacheConfig{}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "size", "shards":
+						subdirective := d.Val()
+						var valueStr string
+						if !d.Args(&valueStr) {
+							return d.ArgErr()
+						}
+						value, err := strconv.Atoi(valueStr)
+						if err != nil {
+							return d.Errf("invalid cache %s '%s': %v", subdirective, valueStr, err)
+						}
+						if subdirective == "size" {
+							g.Cache.Size = value
+						} else {
+							g.Cache.Shards = value
+						}
+
+					case "ttl":
+						var ttlStr string
+						if !d.Args(&ttlStr) {
+							return d.ArgErr()
+						}
+						ttl, err := caddy.ParseDuration(ttlStr)
+						if err != nil {
+							return d.Errf("invalid cache ttl '%s': %v", ttlStr, err)
+						}
+						g.Cache.TTL = caddy.Duration(ttl)
+
+					default:
+						return d.Errf("unknown cache subdirective: %s", d.Val())
+					}
+				}
+
+			case "watch":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				g.Watch = &WatchConfig{}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "debounce":
+						var debounceStr string
+						if !d.Args(&debounceStr) {
+							return d.ArgErr()
+						}
+						debounce, err := caddy.ParseDuration(debounceStr)
+						if err != nil {
+							return d.Errf("invalid watch debounce '%s': %v", debounceStr, err)
+						}
+						g.Watch.Debounce = caddy.Duration(debounce)
+
+					default:
+						return d.Errf("unknown watch subdirective: %s", d.Val())
+					}
 				}
 
 			case "reload_interval":
@@ -270,11 +496,25 @@ func (g *GeoIP2State) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		zap.String("city_database_path", g.CityDatabasePath),
 		zap.String("global_city_database_path", g.GlobalCityDatabasePath),
 		zap.String("asn_database_path", g.ASNDatabasePath),
+		zap.String("anonymous_ip_database_path", g.AnonymousIPDatabasePath),
+		zap.String("isp_database_path", g.ISPDatabasePath),
+		zap.String("connection_type_database_path", g.ConnectionTypeDatabasePath),
+		zap.String("enterprise_database_path", g.EnterpriseDatabasePath),
+		zap.Int("databases", len(g.Databases)),
 		zap.String("reload_interval", fmt.Sprintf("%dh", g.ReloadInterval)))
 
 	return nil
 }
 
+// expandDatabasePath expands environment variables and resolves relative paths
+func expandDatabasePath(path string) string {
+	path = os.ExpandEnv(path)
+	if !filepath.IsAbs(path) {
+		path, _ = filepath.Abs(path)
+	}
+	return path
+}
+
 // parseReloadInterval converts various interval formats to hours
 // Supported formats: "daily", "24h", "1d", "2", "48"
 func (g *GeoIP2State) parseReloadInterval(intervalStr string) (int, error) {
@@ -298,151 +538,228 @@ func (g *GeoIP2State) parseReloadInterval(intervalStr string) (int, error) {
 }
 
 // setDefaults applies default values for unspecified configuration
+// Path shorthands only get a default if no database of that name is configured
 func (g *GeoIP2State) setDefaults() {
-	if g.CountryDatabasePath == "" {
+	// The Enterprise database replaces the default country and city databases
+	if _, ok := g.Databases[DatabaseEnterprise]; ok || g.EnterpriseDatabasePath != "" {
+		return
+	}
+	if _, ok := g.Databases[DatabaseCountry]; !ok && g.CountryDatabasePath == "" {
 		g.CountryDatabasePath = "/etc/nginx/maxmind-geo-ip/GeoIP-Country/GeoIP2-Country.mmdb"
 	}
-	if g.CityDatabasePath == "" {
+	// City routes name their own databases, the default city databases are only used by the EU split
+	if len(g.CityRoutes) > 0 || g.DefaultCityDatabase != "" {
+		return
+	}
+	if _, ok := g.Databases[DatabaseCity]; !ok && g.CityDatabasePath == "" {
 		g.CityDatabasePath = "/etc/nginx/maxmind-geo-ip/GeoIP-Country/GeoIP2-City-Europe.mmdb"
 	}
-	if g.GlobalCityDatabasePath == "" {
+	if _, ok := g.Databases[DatabaseGlobalCity]; !ok && g.GlobalCityDatabasePath == "" {
 		g.GlobalCityDatabasePath = "/etc/nginx/maxmind-geo-ip/GeoLite2-City.mmdb"
 	}
 	// Note: ReloadInterval of 0 (no auto-reload) is a valid default
 }
 
-// loadDatabase loads or reloads the GeoIP2 database from disk
-// This method is thread-safe and can be called concurrently
-// Supports loading all three databases
-func (g *GeoIP2State) loadDatabase() error {
-	// Validate country database file exists and is readable
-	if err := g.validateDatabaseFile(g.CountryDatabasePath); err != nil {
-		return fmt.Errorf("country database validation failed: %v", err)
+// buildDatabaseConfigs merges the path shorthands into the database registry
+// Explicit entries in Databases take precedence over the shorthands
+func (g *GeoIP2State) buildDatabaseConfigs() map[string]*DatabaseConfig {
+	configs := make(map[string]*DatabaseConfig, len(g.Databases)+8)
+
+	shorthands := []struct {
+		name     string
+		path     string
+		optional bool
+	}{
+		{DatabaseCountry, g.CountryDatabasePath, false},
+		{DatabaseCity, g.CityDatabasePath, false},
+		{DatabaseGlobalCity, g.GlobalCityDatabasePath, true},
+		{DatabaseASN, g.ASNDatabasePath, true},
+		{DatabaseAnonymousIP, g.AnonymousIPDatabasePath, true},
+		{DatabaseISP, g.ISPDatabasePath, true},
+		{DatabaseConnectionType, g.ConnectionTypeDatabasePath, true},
+		{DatabaseEnterprise, g.EnterpriseDatabasePath, false},
+	}
+	for _, s := range shorthands {
+		if s.path != "" {
+			configs[s.name] = &DatabaseConfig{Path: s.path, Optional: s.optional}
+		}
 	}
 
-	// Validate city database file exists and is readable
-	if err := g.validateDatabaseFile(g.CityDatabasePath); err != nil {
-		return fmt.Errorf("city database validation failed: %v", err)
+	for name, db := range g.Databases {
+		configs[name] = db
 	}
 
-	// Validate global city database file exists and is readable
-	if err := g.validateDatabaseFile(g.GlobalCityDatabasePath); err != nil {
-		caddy.Log().Named("geoip2").Warn("global city database validation failed, global city data will be empty",
-			zap.String("global_city_path", g.GlobalCityDatabasePath),
-			zap.Error(err))
+	return configs
+}
+
+// databaseNames returns the configured database names in a stable order
+func (g *GeoIP2State) databaseNames() []string {
+	names := make([]string, 0, len(g.dbConfigs))
+	for name := range g.dbConfigs {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	// Validate ASN database if specified
-	var asnDBValid bool
-	if g.ASNDatabasePath != "" {
-		if err := g.validateDatabaseFile(g.ASNDatabasePath); err != nil {
-			caddy.Log().Named("geoip2").Warn("ASN database validation failed, ASN data will be empty",
-				zap.String("asn_path", g.ASNDatabasePath),
-				zap.Error(err))
-		} else {
-			asnDBValid = true
+// languages returns the language preference list for localized names
+func (g *GeoIP2State) languages() []string {
+	if len(g.Languages) > 0 {
+		return g.Languages
+	}
+	return DefaultLanguages
+}
+
+// reloadIntervalFor returns the effective reload interval of a database in hours
+func (g *GeoIP2State) reloadIntervalFor(name string) int {
+	if db := g.dbConfigs[name]; db != nil && db.ReloadInterval != nil {
+		return *db.ReloadInterval
+	}
+	return g.ReloadInterval
+}
+
+// loadDatabase loads all configured GeoIP2 databases from disk
+func (g *GeoIP2State) loadDatabase() error {
+	return g.loadDatabases(g.databaseNames())
+}
+
+// loadDatabases loads or reloads a set of databases, leaving all others untouched
+// The reload is transactional: all databases of the set are opened and checked against
+// the loaded versions without holding any lock, and only if all required ones pass are
+// they swapped in together as one snapshot; on any failure the new readers are closed
+// and the previous set stays live
+// Optional databases that fail to load or fail the checks keep their previous version
+// Lookups in progress finish on the previous snapshot, which is closed afterwards
+func (g *GeoIP2State) loadDatabases(names []string) error {
+	opened := make(map[string]*maxminddb.Reader, len(names))
+	for _, name := range names {
+		reader, err := g.openDatabase(name)
+		if err != nil {
+			// Don't leak the databases opened so far
+			closeReaders(opened)
+			return err
+		}
+		if reader != nil {
+			opened[name] = reader
 		}
 	}
 
-	// Acquire exclusive lock for database replacement
-	g.mutex.Lock()
-	defer g.mutex.Unlock()
+	// Readers that were opened but are not swapped in
+	rejected := make(map[string]*maxminddb.Reader)
+	err := g.databases.update(func(current map[string]*maxminddb.Reader) (map[string]*maxminddb.Reader, error) {
+		// Carry over the databases that are not part of this reload
+		readers := make(map[string]*maxminddb.Reader, len(current)+len(names))
+		for name, reader := range current {
+			readers[name] = reader
+		}
 
-	// Open new country database instance
-	newCountryDB, err := maxminddb.Open(g.CountryDatabasePath)
+		for _, name := range names {
+			reader := opened[name]
+			if reader == nil {
+				// Optional database failed to load, keep serving the previous version if any
+				continue
+			}
+			if err := checkDatabase(name, current[name], reader); err != nil {
+				if !g.dbConfigs[name].Optional {
+					return nil, err
+				}
+				caddy.Log().Named("geoip2").Warn("optional database failed the reload checks, keeping the previous version",
+					zap.String("database", name),
+					zap.Error(err))
+				rejected[name] = reader
+				continue
+			}
+			readers[name] = reader
+		}
+		return readers, nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to open country database %s: %v", g.CountryDatabasePath, err)
+		closeReaders(opened)
+		return err
 	}
+	closeReaders(rejected)
 
-	// Open new city database instance
-	newCityDB, err := maxminddb.Open(g.CityDatabasePath)
-	if err != nil {
-		return fmt.Errorf("failed to open city database %s: %v", g.CityDatabasePath, err)
+	// Cached results of the old databases can no longer be served, free their memory
+	if g.cache != nil {
+		g.cache.clear()
 	}
 
-	// Open global city database instance
-	newGlobalCityDB, err := maxminddb.Open(g.GlobalCityDatabasePath)
-	if err != nil {
-		caddy.Log().Named("geoip2").Warn("failed to open global city database, global city data will be empty",
-			zap.String("global_city_path", g.GlobalCityDatabasePath),
-			zap.Error(err))
-		newGlobalCityDB = nil
+	return nil
+}
+
+// checkDatabase sanity-checks a newly opened database before it replaces the loaded version
+// A replacement must have the same type (or another type expected for a well-known name),
+// must not drop IPv6 support and must not be older than the loaded version
+func checkDatabase(name string, current, next *maxminddb.Reader) error {
+	meta := next.Metadata
+	if meta.IPVersion != 4 && meta.IPVersion != 6 {
+		return fmt.Errorf("%s database: unsupported IP version %d", name, meta.IPVersion)
+	}
+	if current == nil {
+		return nil
 	}
 
-	// Open ASN database if valid
-	var newASNDB *maxminddb.Reader
-	if asnDBValid {
-		newASNDB, err = maxminddb.Open(g.ASNDatabasePath)
-		if err != nil {
-			caddy.Log().Named("geoip2").Warn("failed to open ASN database, ASN data will be empty",
-				zap.String("asn_path", g.ASNDatabasePath),
-				zap.Error(err))
-			newASNDB = nil
-		}
+	loaded := current.Metadata
+	if meta.DatabaseType != loaded.DatabaseType &&
+		!(containsString(knownDatabaseTypes[name], meta.DatabaseType) && containsString(knownDatabaseTypes[name], loaded.DatabaseType)) {
+		return fmt.Errorf("%s database: type changed from %s to %s", name, loaded.DatabaseType, meta.DatabaseType)
 	}
+	if meta.IPVersion < loaded.IPVersion {
+		return fmt.Errorf("%s database: IP version changed from %d to %d", name, loaded.IPVersion, meta.IPVersion)
+	}
+	if meta.BuildEpoch < loaded.BuildEpoch {
+		return fmt.Errorf("%s database: build %s is older than the loaded build %s", name,
+			time.Unix(int64(meta.BuildEpoch), 0).UTC().Format(time.RFC3339),
+			time.Unix(int64(loaded.BuildEpoch), 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
 
-	// Close old databases if present
-	if g.CountryDBHandler != nil {
-		if err := g.CountryDBHandler.Close(); err != nil {
-			caddy.Log().Named("geoip2").Warn("error closing old country database",
+// closeReaders closes database readers that were never published in a snapshot
+func closeReaders(readers map[string]*maxminddb.Reader) {
+	for name, reader := range readers {
+		if err := reader.Close(); err != nil {
+			caddy.Log().Named("geoip2").Warn("error closing database",
+				zap.String("database", name),
 				zap.Error(err))
 		}
 	}
-	if g.CityDBHandler != nil {
-		if err := g.CityDBHandler.Close(); err != nil {
-			caddy.Log().Named("geoip2").Warn("error closing old city database",
-				zap.Error(err))
-		}
+}
+
+// openDatabase validates and opens a named database
+// Failures of optional databases are logged and return a nil reader without error
+func (g *GeoIP2State) openDatabase(name string) (*maxminddb.Reader, error) {
+	db := g.dbConfigs[name]
+	if db == nil {
+		return nil, fmt.Errorf("unknown database: %s", name)
 	}
-	if g.GlobalCityDBHandler != nil {
-		if err := g.GlobalCityDBHandler.Close(); err != nil {
-			caddy.Log().Named("geoip2").Warn("error closing old global city database",
-				zap.Error(err))
-		}
+
+	// Validate database file exists and is readable, then open it
+	err := g.validateDatabaseFile(db.Path)
+	var reader *maxminddb.Reader
+	if err == nil {
+		reader, err = maxminddb.Open(db.Path)
 	}
-	if g.ASNDBHandler != nil {
-		if err := g.ASNDBHandler.Close(); err != nil {
-			caddy.Log().Named("geoip2").Warn("error closing old ASN database",
+	if err != nil {
+		if db.Optional {
+			caddy.Log().Named("geoip2").Warn("failed to open optional database, its data will be empty",
+				zap.String("database", name),
+				zap.String("path", db.Path),
 				zap.Error(err))
+			return nil, nil
 		}
+		return nil, fmt.Errorf("failed to open %s database %s: %v", name, db.Path, err)
 	}
 
-	// Replace with new databases
-	g.CountryDBHandler = newCountryDB
-	g.CityDBHandler = newCityDB
-	g.GlobalCityDBHandler = newGlobalCityDB
-	g.ASNDBHandler = newASNDB
-
 	// Log successful load with database metadata
-	countryMetadata := newCountryDB.Metadata
-	caddy.Log().Named("geoip2").Info("country database loaded successfully",
-		zap.String("path", g.CountryDatabasePath),
-		zap.Uint64("build_epoch", uint64(countryMetadata.BuildEpoch)),
-		zap.String("database_type", countryMetadata.DatabaseType))
-
-	cityMetadata := newCityDB.Metadata
-	caddy.Log().Named("geoip2").Info("city database loaded successfully",
-		zap.String("path", g.CityDatabasePath),
-		zap.Uint64("build_epoch", uint64(cityMetadata.BuildEpoch)),
-		zap.String("database_type", cityMetadata.DatabaseType))
-
-	if newGlobalCityDB != nil {
-		globalCityMetadata := newGlobalCityDB.Metadata
-		caddy.Log().Named("geoip2").Info("global city database loaded successfully",
-			zap.String("path", g.GlobalCityDatabasePath),
-			zap.Uint64("build_epoch", uint64(globalCityMetadata.BuildEpoch)),
-			zap.String("database_type", globalCityMetadata.DatabaseType))
-	}
-
-	if newASNDB != nil {
-		asnMetadata := newASNDB.Metadata
-		caddy.Log().Named("geoip2").Info("ASN database loaded successfully",
-			zap.String("path", g.ASNDatabasePath),
-			zap.Uint64("build_epoch", uint64(asnMetadata.BuildEpoch)),
-			zap.String("database_type", asnMetadata.DatabaseType))
-	}
-
-	return nil
+	metadata := reader.Metadata
+	caddy.Log().Named("geoip2").Info("database loaded successfully",
+		zap.String("database", name),
+		zap.String("path", db.Path),
+		zap.Uint64("build_epoch", uint64(metadata.BuildEpoch)),
+		zap.String("database_type", metadata.DatabaseType))
+
+	return reader, nil
 }
 
 // validateDatabaseFile checks if the database file exists and is accessible
@@ -469,26 +786,37 @@ func (g *GeoIP2State) validateDatabaseFile(path string) error {
 	return nil
 }
 
-// startReloadTimer starts a background goroutine that periodically reloads the database
-func (g *GeoIP2State) startReloadTimer() {
-	g.done = make(chan bool, 1)
+// reloadGroups groups the databases with automatic reloading by their reload interval in hours
+func (g *GeoIP2State) reloadGroups() map[int][]string {
+	groups := make(map[int][]string)
+	for _, name := range g.databaseNames() {
+		if hours := g.reloadIntervalFor(name); hours > 0 {
+			groups[hours] = append(groups[hours], name)
+		}
+	}
+	return groups
+}
 
+// startReloadTimer starts a background goroutine that periodically reloads a set of databases
+func (g *GeoIP2State) startReloadTimer(names []string, hours int) {
 	go func() {
-		interval := time.Duration(g.ReloadInterval) * time.Hour
+		interval := time.Duration(hours) * time.Hour
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
 		caddy.Log().Named("geoip2").Info("started database reload timer",
+			zap.Strings("databases", names),
 			zap.Duration("interval", interval),
 			zap.String("next_reload", time.Now().Add(interval).Format(time.RFC3339)))
 
 		for {
 			select {
 			case <-ticker.C:
-				g.performScheduledReload()
+				g.performScheduledReload(names, interval)
 
 			case <-g.done:
-				caddy.Log().Named("geoip2").Debug("reload timer stopped")
+				caddy.Log().Named("geoip2").Debug("reload timer stopped",
+					zap.Strings("databases", names))
 				return
 			}
 		}
@@ -496,31 +824,48 @@ func (g *GeoIP2State) startReloadTimer() {
 }
 
 // performScheduledReload handles the actual database reload with error handling
-func (g *GeoIP2State) performScheduledReload() {
-	caddy.Log().Named("geoip2").Info("performing scheduled database reload")
+func (g *GeoIP2State) performScheduledReload(names []string, interval time.Duration) {
+	caddy.Log().Named("geoip2").Info("performing scheduled database reload",
+		zap.Strings("databases", names))
 
 	startTime := time.Now()
-	if err := g.loadDatabase(); err != nil {
-		caddy.Log().Named("geoip2").Error("scheduled database reload failed",
+	if err := g.loadDatabases(names); err != nil {
+		caddy.Log().Named("geoip2").Error("scheduled database reload failed, keeping the previous databases",
+			zap.Strings("databases", names),
 			zap.Error(err),
 			zap.Duration("duration", time.Since(startTime)))
 	} else {
 		caddy.Log().Named("geoip2").Info("scheduled database reload completed",
+			zap.Strings("databases", names),
 			zap.Duration("duration", time.Since(startTime)),
-			zap.String("next_reload", time.Now().Add(time.Duration(g.ReloadInterval)*time.Hour).Format(time.RFC3339)))
+			zap.String("next_reload", time.Now().Add(interval).Format(time.RFC3339)))
 	}
 }
 
-// Lookup performs a thread-safe GeoIP lookup
-// This is the main API used by the HTTP handlers
-func (g *GeoIP2State) Lookup(ip interface{}, result interface{}) error {
-	// Acquire read lock for database access
-	g.mutex.RLock()
-	defer g.mutex.RUnlock()
+// LookupIn performs a thread-safe lookup in the named database
+// This is the main API used by the HTTP handlers and matchers
+func (g *GeoIP2State) LookupIn(name string, ip interface{}, result interface{}) error {
+	_, err := g.LookupNetworkIn(name, ip, result)
+	return err
+}
+
+// LookupNetworkIn performs a thread-safe lookup in the named database and also returns
+// the network the record applies to (invalid if the database returned no network)
+func (g *GeoIP2State) LookupNetworkIn(name string, ip interface{}, result interface{}) (netip.Prefix, error) {
+	// Hold a reference so the snapshot's readers stay open during the lookup
+	var snap *databaseSnapshot
+	if g.databases != nil {
+		snap = g.databases.acquire()
+	}
+	if snap == nil {
+		return netip.Prefix{}, fmt.Errorf("%s database not loaded", name)
+	}
+	defer snap.release()
 
-	// Check if country database is available
-	if g.CountryDBHandler == nil {
-		return errors.New("country database not loaded")
+	// Check if the database is available
+	reader := snap.readers[name]
+	if reader == nil {
+		return netip.Prefix{}, fmt.Errorf("%s database not loaded", name)
 	}
 
 	// Convert interface{} to net.IP if needed
@@ -531,149 +876,155 @@ func (g *GeoIP2State) Lookup(ip interface{}, result interface{}) error {
 	case string:
 		netIP = net.ParseIP(v)
 		if netIP == nil {
-			return fmt.Errorf("invalid IP address: %s", v)
+			return netip.Prefix{}, fmt.Errorf("invalid IP address: %s", v)
 		}
 	default:
-		return fmt.Errorf("unsupported IP type: %T", ip)
+		return netip.Prefix{}, fmt.Errorf("unsupported IP type: %T", ip)
+	}
+
+	// Serve repeated lookups from the cache, keyed by the network of the record
+	if g.cache != nil {
+		if network, ok := g.cache.get(name, snap.generation, netIP, result); ok {
+			return network, nil
+		}
 	}
 
 	// Perform the actual lookup
-	return g.CountryDBHandler.Lookup(netIP, result)
+	ipNet, _, err := reader.LookupNetwork(netIP, result)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	network, _ := networkPrefix(ipNet)
+	if g.cache != nil {
+		g.cache.put(name, snap.generation, network, result)
+	}
+	return network, nil
 }
 
-// LookupCity performs a thread-safe City database lookup
-// Used for city names, subdivisions, and geographic coordinates
-func (g *GeoIP2State) LookupCity(ip interface{}, result interface{}) error {
-	// Acquire read lock for database access
-	g.mutex.RLock()
-	defer g.mutex.RUnlock()
-
-	// Check if city database is available
-	if g.CityDBHandler == nil {
-		return errors.New("city database not loaded")
+// HasDatabase reports whether the named database is currently loaded
+func (g *GeoIP2State) HasDatabase(name string) bool {
+	if g.databases == nil {
+		return false
 	}
+	snap := g.databases.load()
+	return snap != nil && snap.readers[name] != nil
+}
 
-	// Convert interface{} to net.IP if needed
-	var netIP net.IP
-	switch v := ip.(type) {
-	case net.IP:
-		netIP = v
-	case string:
-		netIP = net.ParseIP(v)
-		if netIP == nil {
-			return fmt.Errorf("invalid IP address: %s", v)
-		}
-	default:
-		return fmt.Errorf("unsupported IP type: %T", ip)
-	}
+// Lookup performs a thread-safe Country database lookup
+// Used for country code and EU status lookups
+func (g *GeoIP2State) Lookup(ip interface{}, result interface{}) error {
+	return g.LookupIn(DatabaseCountry, ip, result)
+}
 
-	// Perform the actual city lookup
-	return g.CityDBHandler.Lookup(netIP, result)
+// LookupCity performs a thread-safe City database lookup
+// Used for city names, subdivisions, and geographic coordinates
+func (g *GeoIP2State) LookupCity(ip interface{}, result interface{}) error {
+	return g.LookupIn(DatabaseCity, ip, result)
 }
 
 // LookupGlobalCity performs a thread-safe global City database lookup
 // Used for city data for non-European IPs as fallback
 func (g *GeoIP2State) LookupGlobalCity(ip interface{}, result interface{}) error {
-	// Acquire read lock for database access
-	g.mutex.RLock()
-	defer g.mutex.RUnlock()
-
-	// Check if global city database is available
-	if g.GlobalCityDBHandler == nil {
-		return errors.New("global city database not loaded")
-	}
-
-	// Convert interface{} to net.IP if needed
-	var netIP net.IP
-	switch v := ip.(type) {
-	case net.IP:
-		netIP = v
-	case string:
-		netIP = net.ParseIP(v)
-		if netIP == nil {
-			return fmt.Errorf("invalid IP address: %s", v)
-		}
-	default:
-		return fmt.Errorf("unsupported IP type: %T", ip)
-	}
-
-	// Perform the actual global city lookup
-	return g.GlobalCityDBHandler.Lookup(netIP, result)
+	return g.LookupIn(DatabaseGlobalCity, ip, result)
 }
 
 // LookupASN performs a thread-safe ASN database lookup
 // Used for ASN number and organization lookups
 func (g *GeoIP2State) LookupASN(ip interface{}, result interface{}) error {
-	// Acquire read lock for database access
-	g.mutex.RLock()
-	defer g.mutex.RUnlock()
+	return g.LookupIn(DatabaseASN, ip, result)
+}
+
+// LookupAnonymousIP performs a thread-safe Anonymous IP database lookup
+// Used for VPN, proxy, hosting provider and Tor exit node detection
+func (g *GeoIP2State) LookupAnonymousIP(ip interface{}, result interface{}) error {
+	return g.LookupIn(DatabaseAnonymousIP, ip, result)
+}
+
+// LookupISP performs a thread-safe ISP database lookup
+// Used for ISP, organization and mobile network lookups
+func (g *GeoIP2State) LookupISP(ip interface{}, result interface{}) error {
+	return g.LookupIn(DatabaseISP, ip, result)
+}
+
+// LookupConnectionType performs a thread-safe Connection-Type database lookup
+// Used for connection type lookups (Cable/DSL, Cellular, Corporate, Satellite)
+func (g *GeoIP2State) LookupConnectionType(ip interface{}, result interface{}) error {
+	return g.LookupIn(DatabaseConnectionType, ip, result)
+}
+
+// LookupEnterprise performs a thread-safe Enterprise database lookup
+// Used to answer all lookups from a single record
+func (g *GeoIP2State) LookupEnterprise(ip interface{}, result interface{}) error {
+	return g.LookupIn(DatabaseEnterprise, ip, result)
+}
 
-	// Check if ASN database is available
-	if g.ASNDBHandler == nil {
-		return errors.New("ASN database not loaded")
+// lookupCountryRecord performs the Country lookup, from the Enterprise database if configured
+func (g *GeoIP2State) lookupCountryRecord(ip net.IP, record *CountryRecord) error {
+	if g.HasDatabase(DatabaseEnterprise) {
+		return g.LookupEnterprise(ip, record)
 	}
+	return g.Lookup(ip, record)
+}
 
-	// Convert interface{} to net.IP if needed
-	var netIP net.IP
-	switch v := ip.(type) {
-	case net.IP:
-		netIP = v
-	case string:
-		netIP = net.ParseIP(v)
-		if netIP == nil {
-			return fmt.Errorf("invalid IP address: %s", v)
+// lookupASNRecord performs the ASN lookup, from the Enterprise database traits if configured
+func (g *GeoIP2State) lookupASNRecord(ip net.IP, record *ASNRecord) error {
+	if g.HasDatabase(DatabaseEnterprise) {
+		var enterpriseRecord struct {
+			Traits ASNRecord `maxminddb:"traits"`
 		}
-	default:
-		return fmt.Errorf("unsupported IP type: %T", ip)
+		err := g.LookupEnterprise(ip, &enterpriseRecord)
+		*record = enterpriseRecord.Traits
+		return err
 	}
+	return g.LookupASN(ip, record)
+}
 
-	// Perform the actual ASN lookup
-	return g.ASNDBHandler.Lookup(netIP, result)
+// CacheStats returns the statistics of the lookup cache
+// Returns false if caching is not enabled
+func (g *GeoIP2State) CacheStats() (CacheStats, bool) {
+	if g.cache == nil {
+		return CacheStats{}, false
+	}
+	return g.cache.stats(), true
 }
 
-// GetDatabaseInfo returns information about the currently loaded database
+// GetDatabaseInfo returns information about the currently loaded databases
 // Useful for monitoring and debugging
 func (g *GeoIP2State) GetDatabaseInfo() map[string]interface{} {
-	g.mutex.RLock()
-	defer g.mutex.RUnlock()
+	var readers map[string]*maxminddb.Reader
+	if g.databases != nil {
+		if snap := g.databases.acquire(); snap != nil {
+			defer snap.release()
+			readers = snap.readers
+		}
+	}
 
 	info := map[string]interface{}{
-		"country_database_path":     g.CountryDatabasePath,
-		"city_database_path":        g.CityDatabasePath,
-		"global_city_database_path": g.GlobalCityDatabasePath,
-		"asn_database_path":         g.ASNDatabasePath,
-		"reload_interval":           g.ReloadInterval,
-		"country_loaded":            g.CountryDBHandler != nil,
-		"city_loaded":               g.CityDBHandler != nil,
-		"global_city_loaded":        g.GlobalCityDBHandler != nil,
-		"asn_loaded":                g.ASNDBHandler != nil,
-	}
-
-	if g.CountryDBHandler != nil {
-		metadata := g.CountryDBHandler.Metadata
-		info["country_build_epoch"] = metadata.BuildEpoch
-		info["country_database_type"] = metadata.DatabaseType
-		info["country_ip_version"] = metadata.IPVersion
-		info["country_record_size"] = metadata.RecordSize
-		info["country_node_count"] = metadata.NodeCount
-	}
-
-	if g.CityDBHandler != nil {
-		metadata := g.CityDBHandler.Metadata
-		info["city_build_epoch"] = metadata.BuildEpoch
-		info["city_database_type"] = metadata.DatabaseType
-		info["city_ip_version"] = metadata.IPVersion
-		info["city_record_size"] = metadata.RecordSize
-		info["city_node_count"] = metadata.NodeCount
-	}
-
-	if g.GlobalCityDBHandler != nil {
-		metadata := g.GlobalCityDBHandler.Metadata
-		info["global_city_build_epoch"] = metadata.BuildEpoch
-		info["global_city_database_type"] = metadata.DatabaseType
-		info["global_city_ip_version"] = metadata.IPVersion
-		info["global_city_record_size"] = metadata.RecordSize
-		info["global_city_node_count"] = metadata.NodeCount
+		"reload_interval": g.ReloadInterval,
+	}
+
+	if g.cache != nil {
+		stats := g.cache.stats()
+		info["cache_hits"] = stats.Hits
+		info["cache_misses"] = stats.Misses
+		info["cache_evictions"] = stats.Evictions
+		info["cache_entries"] = stats.Entries
+	}
+
+	for name, db := range g.dbConfigs {
+		reader := readers[name]
+		info[name+"_database_path"] = db.Path
+		info[name+"_reload_interval"] = g.reloadIntervalFor(name)
+		info[name+"_loaded"] = reader != nil
+
+		if reader != nil {
+			metadata := reader.Metadata
+			info[name+"_build_epoch"] = metadata.BuildEpoch
+			info[name+"_database_type"] = metadata.DatabaseType
+			info[name+"_ip_version"] = metadata.IPVersion
+			info[name+"_record_size"] = metadata.RecordSize
+			info[name+"_node_count"] = metadata.NodeCount
+		}
 	}
 
 	return info
@@ -682,6 +1033,23 @@ func (g *GeoIP2State) GetDatabaseInfo() map[string]interface{} {
 // Provision is called by Caddy to set up the module
 func (g *GeoIP2State) Provision(ctx caddy.Context) error {
 	caddy.Log().Named("geoip2").Debug("provisioning GeoIP2 app")
+
+	if g.databases == nil {
+		g.databases = newSnapshotStore()
+	}
+	g.dbConfigs = g.buildDatabaseConfigs()
+
+	if g.Cache != nil {
+		g.cache = newLookupCache(g.Cache)
+		if err := g.cache.registerMetrics(ctx.GetMetricsRegistry()); err != nil {
+			return err
+		}
+	}
+
+	for _, route := range g.CityRoutes {
+		route.provision()
+	}
+
 	return nil
 }
 
@@ -689,14 +1057,8 @@ func (g *GeoIP2State) Provision(ctx caddy.Context) error {
 // This is called before Start() to catch configuration errors early
 func (g GeoIP2State) Validate() error {
 	// Validate required configuration
-	if g.CountryDatabasePath == "" {
-		return fmt.Errorf("country_database_path is required")
-	}
-	if g.CityDatabasePath == "" {
-		return fmt.Errorf("city_database_path is required")
-	}
-	if g.GlobalCityDatabasePath == "" {
-		return fmt.Errorf("global_city_database_path is required")
+	if len(g.dbConfigs) == 0 {
+		return fmt.Errorf("at least one database is required")
 	}
 
 	// Validate reload interval
@@ -704,72 +1066,81 @@ func (g GeoIP2State) Validate() error {
 		return fmt.Errorf("reload_interval cannot be negative")
 	}
 
-	// Validate database files
-	if err := g.validateDatabaseFile(g.CountryDatabasePath); err != nil {
-		return fmt.Errorf("country database validation failed: %v", err)
-	}
-	if err := g.validateDatabaseFile(g.CityDatabasePath); err != nil {
-		return fmt.Errorf("city database validation failed: %v", err)
-	}
-	if err := g.validateDatabaseFile(g.GlobalCityDatabasePath); err != nil {
-		return fmt.Errorf("global city database validation failed: %v", err)
+	// Validate cache settings
+	if g.Cache != nil {
+		if g.Cache.Size < 0 {
+			return fmt.Errorf("cache size cannot be negative")
+		}
+		if g.Cache.Shards < 0 {
+			return fmt.Errorf("cache shards cannot be negative")
+		}
+		if g.Cache.TTL < 0 {
+			return fmt.Errorf("cache ttl cannot be negative")
+		}
 	}
 
-	// Test databases can be opened
-	countryDB, err := maxminddb.Open(g.CountryDatabasePath)
-	if err != nil {
-		return fmt.Errorf("cannot open country database %s: %v", g.CountryDatabasePath, err)
+	// Validate file watch settings
+	if g.Watch != nil && g.Watch.Debounce < 0 {
+		return fmt.Errorf("watch debounce cannot be negative")
 	}
-	defer countryDB.Close()
 
-	cityDB, err := maxminddb.Open(g.CityDatabasePath)
-	if err != nil {
-		return fmt.Errorf("cannot open city database %s: %v", g.CityDatabasePath, err)
+	if err := g.validateCityRoutes(); err != nil {
+		return err
 	}
-	defer cityDB.Close()
 
-	globalCityDB, err := maxminddb.Open(g.GlobalCityDatabasePath)
-	if err != nil {
-		return fmt.Errorf("cannot open global city database %s: %v", g.GlobalCityDatabasePath, err)
-	}
-	defer globalCityDB.Close()
+	for _, name := range g.databaseNames() {
+		db := g.dbConfigs[name]
+		if db.Path == "" {
+			return fmt.Errorf("%s database: path is required", name)
+		}
+		if db.ReloadInterval != nil && *db.ReloadInterval < 0 {
+			return fmt.Errorf("%s database: reload_interval cannot be negative", name)
+		}
 
-	// Validate country database type (should be Country database)
-	countryMetadata := countryDB.Metadata
-	if countryMetadata.DatabaseType != "GeoLite2-Country" &&
-		countryMetadata.DatabaseType != "GeoIP2-Country" {
-		caddy.Log().Named("geoip2").Warn("unknown country database type",
-			zap.String("type", countryMetadata.DatabaseType))
-	}
+		// Validate database file and test that it can be opened
+		err := g.validateDatabaseFile(db.Path)
+		var reader *maxminddb.Reader
+		if err == nil {
+			reader, err = maxminddb.Open(db.Path)
+		}
+		if err != nil {
+			if db.Optional {
+				caddy.Log().Named("geoip2").Warn("optional database validation failed",
+					zap.String("database", name),
+					zap.Error(err))
+				continue
+			}
+			return fmt.Errorf("%s database validation failed: %v", name, err)
+		}
 
-	// Validate city database type (should be City database)
-	cityMetadata := cityDB.Metadata
-	if cityMetadata.DatabaseType != "GeoLite2-City" &&
-		cityMetadata.DatabaseType != "GeoIP2-City" &&
-		cityMetadata.DatabaseType != "GeoIP2-City-Europe" {
-		caddy.Log().Named("geoip2").Warn("unknown city database type",
-			zap.String("type", cityMetadata.DatabaseType))
-	}
+		// Validate database type for well-known names
+		metadata := reader.Metadata
+		reader.Close()
+		if expected, ok := knownDatabaseTypes[name]; ok && !containsString(expected, metadata.DatabaseType) {
+			caddy.Log().Named("geoip2").Warn("unknown database type",
+				zap.String("database", name),
+				zap.String("type", metadata.DatabaseType))
+		}
 
-	globalCityMetadata := globalCityDB.Metadata
-	if globalCityMetadata.DatabaseType != "GeoLite2-City" &&
-		globalCityMetadata.DatabaseType != "GeoIP2-City" &&
-		globalCityMetadata.DatabaseType != "GeoIP2-City-Europe" {
-		caddy.Log().Named("geoip2").Warn("unknown global city database type",
-			zap.String("type", globalCityMetadata.DatabaseType))
+		caddy.Log().Named("geoip2").Info("validation successful",
+			zap.String("database", name),
+			zap.String("database_type", metadata.DatabaseType),
+			zap.Uint64("build_epoch", uint64(metadata.BuildEpoch)))
 	}
 
-	caddy.Log().Named("geoip2").Info("validation successful",
-		zap.String("country_database_type", countryMetadata.DatabaseType),
-		zap.Uint64("country_build_epoch", uint64(countryMetadata.BuildEpoch)),
-		zap.String("city_database_type", cityMetadata.DatabaseType),
-		zap.Uint64("city_build_epoch", uint64(cityMetadata.BuildEpoch)),
-		zap.String("global_city_database_type", globalCityMetadata.DatabaseType),
-		zap.Uint64("global_city_build_epoch", uint64(globalCityMetadata.BuildEpoch)))
-
 	return nil
 }
 
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // Interface guards - compile-time checks that we implement required interfaces
 var (
 	_ caddyfile.Unmarshaler = (*GeoIP2State)(nil)
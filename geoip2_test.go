@@ -0,0 +1,656 @@
+package geoip2
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func TestSelectHop(t *testing.T) {
+	tests := []struct {
+		name         string
+		enable       string
+		leftmost     bool
+		trustedCIDRs []string
+		maxHops      int
+		hops         []string
+		want         string
+	}{
+		{
+			name: "rightmost without trust configuration",
+			hops: []string{"1.1.1.1", "10.0.0.2"},
+			want: "10.0.0.2",
+		},
+		{
+			name:     "leftmost as explicit opt-in",
+			leftmost: true,
+			hops:     []string{"1.1.1.1", "10.0.0.2"},
+			want:     "1.1.1.1",
+		},
+		{
+			name:   "leftmost in wild mode",
+			enable: "wild",
+			hops:   []string{"1.1.1.1", "10.0.0.2"},
+			want:   "1.1.1.1",
+		},
+		{
+			name:         "trusted networks take precedence over leftmost",
+			leftmost:     true,
+			trustedCIDRs: []string{"10.0.0.0/8"},
+			hops:         []string{"2.2.2.2", "1.1.1.1", "10.0.0.2"},
+			want:         "1.1.1.1",
+		},
+		{
+			name:         "first untrusted hop from the right",
+			trustedCIDRs: []string{"10.0.0.0/8"},
+			hops:         []string{"2.2.2.2", "1.1.1.1", "10.0.0.2", "10.0.0.1"},
+			want:         "1.1.1.1",
+		},
+		{
+			name:         "single examined hop is trusted",
+			trustedCIDRs: []string{"10.0.0.0/8"},
+			maxHops:      1,
+			hops:         []string{"1.1.1.1", "10.0.0.2"},
+			want:         "",
+		},
+		{
+			name:         "all examined hops are trusted",
+			trustedCIDRs: []string{"10.0.0.0/8"},
+			maxHops:      2,
+			hops:         []string{"1.1.1.1", "10.0.0.2", "10.0.0.1"},
+			want:         "",
+		},
+		{
+			name:         "untrusted hop within the hop limit",
+			trustedCIDRs: []string{"10.0.0.0/8"},
+			maxHops:      2,
+			hops:         []string{"2.2.2.2", "1.1.1.1", "10.0.0.1"},
+			want:         "1.1.1.1",
+		},
+		{
+			name:         "whole chain trusted",
+			trustedCIDRs: []string{"private_ranges"},
+			hops:         []string{"192.168.1.1", "10.0.0.1"},
+			want:         "",
+		},
+		{
+			name:    "hop limit without trusted networks",
+			maxHops: 2,
+			hops:    []string{"2.2.2.2", "1.1.1.1", "3.3.3.3"},
+			want:    "3.3.3.3",
+		},
+		{
+			name:         "invalid hop is never trusted",
+			trustedCIDRs: []string{"10.0.0.0/8"},
+			hops:         []string{"1.1.1.1", "unknown", "10.0.0.1"},
+			want:         "unknown",
+		},
+		{
+			name:         "chain shorter than the hop limit",
+			trustedCIDRs: []string{"10.0.0.0/8"},
+			maxHops:      5,
+			hops:         []string{"1.1.1.1", "10.0.0.1"},
+			want:         "1.1.1.1",
+		},
+		{
+			name:         "IPv6 hops with ports",
+			trustedCIDRs: []string{"2001:db8::/32"},
+			hops:         []string{"[2001:4860::1]:4711", "[2001:db8::1]:80"},
+			want:         "[2001:4860::1]:4711",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := parseTrustedCIDRs(tt.trustedCIDRs)
+			if err != nil {
+				t.Fatalf("parsing trusted CIDRs: %v", err)
+			}
+			m := &GeoIP2{Enable: tt.enable, Leftmost: tt.leftmost, MaxHops: tt.maxHops, trustedCIDRs: trusted}
+			if got := m.selectHop(tt.hops); got != tt.want {
+				t.Errorf("selectHop(%q) = %q, want %q", tt.hops, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlreadyOnTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		template string
+		target   string
+		want     bool
+	}{
+		{
+			name:     "absolute target on another host",
+			host:     "www.example.com",
+			path:     "/x",
+			template: "https://de.example.com{uri}",
+			target:   "https://de.example.com/x",
+			want:     false,
+		},
+		{
+			name:     "absolute target at the root of the same host",
+			host:     "de.example.com",
+			path:     "/x",
+			template: "https://de.example.com{uri}",
+			target:   "https://de.example.com/x",
+			want:     true,
+		},
+		{
+			name:     "absolute target with another path on the same host",
+			host:     "shop.example.com",
+			path:     "/foo",
+			template: "https://shop.example.com/us{uri}",
+			target:   "https://shop.example.com/us/foo",
+			want:     false,
+		},
+		{
+			name:     "absolute target with the path already applied",
+			host:     "shop.example.com:8443",
+			path:     "/us/foo",
+			template: "https://shop.example.com/us{uri}",
+			target:   "https://shop.example.com/us/us/foo",
+			want:     true,
+		},
+		{
+			name:     "placeholder host with a path prefix",
+			host:     "shop.example.com",
+			path:     "/x",
+			template: "https://{host}/de{uri}",
+			target:   "https://shop.example.com/de/x",
+			want:     false,
+		},
+		{
+			name:     "placeholder host with the path already applied",
+			host:     "shop.example.com",
+			path:     "/de/x",
+			template: "https://{host}/de{uri}",
+			target:   "https://shop.example.com/de/de/x",
+			want:     true,
+		},
+		{
+			name:     "protocol-relative template",
+			host:     "shop.example.com",
+			path:     "/x",
+			template: "//{host}/de{uri}",
+			target:   "//shop.example.com/de/x",
+			want:     false,
+		},
+		{
+			name:     "relative target",
+			host:     "shop.example.com",
+			path:     "/foo",
+			template: "/us{uri}",
+			target:   "/us/foo",
+			want:     false,
+		},
+		{
+			name:     "relative target already applied",
+			host:     "shop.example.com",
+			path:     "/us/foo",
+			template: "/us{uri}",
+			target:   "/us/us/foo",
+			want:     true,
+		},
+		{
+			name:     "relative prefix matches whole segments only",
+			host:     "shop.example.com",
+			path:     "/usa-deals",
+			template: "/us{uri}",
+			target:   "/us/usa-deals",
+			want:     false,
+		},
+		{
+			name:     "relative prefix equals the path",
+			host:     "shop.example.com",
+			path:     "/us",
+			template: "/us/",
+			target:   "/us/",
+			want:     true,
+		},
+		{
+			name:     "identical target",
+			host:     "shop.example.com",
+			path:     "/landing",
+			template: "/landing",
+			target:   "/landing",
+			want:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://"+tt.host+tt.path, nil)
+			if got := alreadyOnTarget(r, tt.template, tt.target); got != tt.want {
+				t.Errorf("alreadyOnTarget(%s%s, %q, %q) = %v, want %v", tt.host, tt.path, tt.template, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	type record struct {
+		Names map[string]string
+		Codes []string
+	}
+
+	cached := []struct {
+		database   string
+		generation uint64
+		network    string
+	}{
+		{"city", 1, "192.0.2.0/24"},
+		{"city", 1, "198.51.100.0/22"},
+		{"city", 1, "203.0.113.7/32"},
+		{"city", 1, "2001:db8::/48"},
+		{"asn", 1, "192.0.2.0/25"},
+	}
+
+	tests := []struct {
+		name        string
+		database    string
+		generation  uint64
+		ip          string
+		wantNetwork string
+		wantHit     bool
+	}{
+		{
+			name:        "IPv4 network of a /24",
+			database:    "city",
+			generation:  1,
+			ip:          "192.0.2.200",
+			wantNetwork: "192.0.2.0/24",
+			wantHit:     true,
+		},
+		{
+			name:        "IPv4 network of a /22",
+			database:    "city",
+			generation:  1,
+			ip:          "198.51.103.1",
+			wantNetwork: "198.51.100.0/22",
+			wantHit:     true,
+		},
+		{
+			name:        "IPv4 host network",
+			database:    "city",
+			generation:  1,
+			ip:          "203.0.113.7",
+			wantNetwork: "203.0.113.7/32",
+			wantHit:     true,
+		},
+		{
+			name:       "IPv4 address next to the host network",
+			database:   "city",
+			generation: 1,
+			ip:         "203.0.113.8",
+		},
+		{
+			name:        "IPv6 network",
+			database:    "city",
+			generation:  1,
+			ip:          "2001:db8:0:ffff::1",
+			wantNetwork: "2001:db8::/48",
+			wantHit:     true,
+		},
+		{
+			name:       "IPv6 address outside the network",
+			database:   "city",
+			generation: 1,
+			ip:         "2001:db8:1::1",
+		},
+		{
+			name:        "IPv4-mapped IPv6 address",
+			database:    "city",
+			generation:  1,
+			ip:          "::ffff:192.0.2.1",
+			wantNetwork: "192.0.2.0/24",
+			wantHit:     true,
+		},
+		{
+			name:        "prefix lengths are kept per database",
+			database:    "asn",
+			generation:  1,
+			ip:          "192.0.2.1",
+			wantNetwork: "192.0.2.0/25",
+			wantHit:     true,
+		},
+		{
+			name:       "other database",
+			database:   "asn",
+			generation: 1,
+			ip:         "192.0.2.200",
+		},
+		{
+			name:       "replaced generation",
+			database:   "city",
+			generation: 2,
+			ip:         "192.0.2.200",
+		},
+	}
+
+	c := newLookupCache(&CacheConfig{})
+	for _, e := range cached {
+		rec := record{Names: map[string]string{"en": e.network}, Codes: []string{e.database}}
+		c.put(e.database, e.generation, netip.MustParsePrefix(e.network), &rec)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rec record
+			network, hit := c.get(tt.database, tt.generation, net.ParseIP(tt.ip), &rec)
+			if hit != tt.wantHit {
+				t.Fatalf("get(%s, %d, %s) hit = %v, want %v", tt.database, tt.generation, tt.ip, hit, tt.wantHit)
+			}
+			if !hit {
+				return
+			}
+			if network.String() != tt.wantNetwork {
+				t.Errorf("get(%s, %d, %s) network = %s, want %s", tt.database, tt.generation, tt.ip, network, tt.wantNetwork)
+			}
+			if rec.Names["en"] != tt.wantNetwork || len(rec.Codes) != 1 || rec.Codes[0] != tt.database {
+				t.Errorf("get(%s, %d, %s) record = %+v, want the one cached for %s", tt.database, tt.generation, tt.ip, rec, tt.wantNetwork)
+			}
+		})
+	}
+
+	t.Run("records are not shared with callers", func(t *testing.T) {
+		network := netip.MustParsePrefix("100.64.0.0/10")
+		rec := record{Names: map[string]string{"en": "original"}, Codes: []string{"original"}}
+		c.put("isolation", 1, network, &rec)
+		rec.Names["en"] = "modified after put"
+		rec.Codes[0] = "modified after put"
+
+		var first record
+		if _, hit := c.get("isolation", 1, net.ParseIP("100.64.0.1"), &first); !hit {
+			t.Fatal("get after put missed")
+		}
+		first.Names["en"] = "modified after get"
+		first.Codes[0] = "modified after get"
+
+		var second record
+		if _, hit := c.get("isolation", 1, net.ParseIP("100.64.0.1"), &second); !hit {
+			t.Fatal("second get missed")
+		}
+		if second.Names["en"] != "original" || second.Codes[0] != "original" {
+			t.Errorf("cached record = %+v, want it unchanged", second)
+		}
+	})
+}
+
+func TestSnapshotStore(t *testing.T) {
+	city, asn, newCity := &maxminddb.Reader{}, &maxminddb.Reader{}, &maxminddb.Reader{}
+	s := newSnapshotStore()
+
+	if snap := s.acquire(); snap != nil {
+		t.Fatalf("acquire on an empty store = %+v, want nil", snap)
+	}
+
+	err := s.update(func(current map[string]*maxminddb.Reader) (map[string]*maxminddb.Reader, error) {
+		return map[string]*maxminddb.Reader{"city": city, "asn": asn}, nil
+	})
+	if err != nil {
+		t.Fatalf("first update: %v", err)
+	}
+	first := s.acquire()
+	if first == nil || first.generation != 1 {
+		t.Fatalf("acquire after first update = %+v, want generation 1", first)
+	}
+	if refs := first.refs.Load(); refs != 2 {
+		t.Errorf("refs with one lookup in progress = %d, want 2", refs)
+	}
+
+	// Reload only the city database; the asn reader is carried over
+	err = s.update(func(current map[string]*maxminddb.Reader) (map[string]*maxminddb.Reader, error) {
+		return map[string]*maxminddb.Reader{"city": newCity, "asn": current["asn"]}, nil
+	})
+	if err != nil {
+		t.Fatalf("second update: %v", err)
+	}
+	if got := s.load().generation; got != 2 {
+		t.Errorf("generation after second update = %d, want 2", got)
+	}
+	if len(first.retired) != 1 || first.retired[0] != "city" {
+		t.Errorf("retired readers = %q, want only the replaced city reader", first.retired)
+	}
+	if refs := first.refs.Load(); refs != 1 {
+		t.Errorf("refs of the replaced snapshot with a lookup in progress = %d, want 1", refs)
+	}
+
+	// The lookup on the replaced snapshot finishes and drops the last reference
+	first.release()
+	if refs := first.refs.Load(); refs != 0 {
+		t.Errorf("refs after the last release = %d, want 0", refs)
+	}
+	second := s.acquire()
+	if second == nil || second.readers["asn"] != asn || second.readers["city"] != newCity {
+		t.Fatalf("acquire after second update = %+v, want the carried-over asn and the new city reader", second)
+	}
+	second.release()
+
+	// A failing build keeps the current snapshot
+	err = s.update(func(current map[string]*maxminddb.Reader) (map[string]*maxminddb.Reader, error) {
+		return nil, errStoreClosed
+	})
+	if err == nil || s.load() != second {
+		t.Errorf("failed update = %v, current generation %d, want an error and generation 2", err, s.load().generation)
+	}
+
+	s.close()
+	if snap := s.acquire(); snap != nil {
+		t.Errorf("acquire after close = %+v, want nil", snap)
+	}
+	if len(second.retired) != 2 || second.refs.Load() != 0 {
+		t.Errorf("after close retired = %q refs = %d, want both readers retired and no refs", second.retired, second.refs.Load())
+	}
+	err = s.update(func(current map[string]*maxminddb.Reader) (map[string]*maxminddb.Reader, error) {
+		return map[string]*maxminddb.Reader{"city": city}, nil
+	})
+	if !errors.Is(err, errStoreClosed) {
+		t.Errorf("update after close = %v, want %v", err, errStoreClosed)
+	}
+}
+
+func TestSnapshotStoreConcurrentReloads(t *testing.T) {
+	s := newSnapshotStore()
+	reload := func() error {
+		return s.update(func(current map[string]*maxminddb.Reader) (map[string]*maxminddb.Reader, error) {
+			return map[string]*maxminddb.Reader{"city": {}, "asn": current["asn"]}, nil
+		})
+	}
+	if err := s.update(func(map[string]*maxminddb.Reader) (map[string]*maxminddb.Reader, error) {
+		return map[string]*maxminddb.Reader{"city": {}, "asn": {}}, nil
+	}); err != nil {
+		t.Fatalf("initial update: %v", err)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mutex     sync.Mutex
+		snapshots = make(map[*databaseSnapshot]bool)
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				snap := s.acquire()
+				if snap == nil {
+					t.Error("acquire returned nil while databases are loaded")
+					return
+				}
+				if snap.refs.Load() <= 0 {
+					t.Errorf("acquired snapshot %d without a reference", snap.generation)
+				}
+				_ = snap.readers["city"]
+				mutex.Lock()
+				snapshots[snap] = true
+				mutex.Unlock()
+				snap.release()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := reload(); err != nil {
+					t.Errorf("reload: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	current := s.load()
+	for snap := range snapshots {
+		if snap == current {
+			continue
+		}
+		if refs := snap.refs.Load(); refs != 0 {
+			t.Errorf("replaced snapshot %d still holds %d references", snap.generation, refs)
+		}
+		if len(snap.retired) != 1 || snap.retired[0] != "city" {
+			t.Errorf("replaced snapshot %d retired %q, want only the city reader", snap.generation, snap.retired)
+		}
+	}
+	if refs := current.refs.Load(); refs != 1 {
+		t.Errorf("refs of the current snapshot = %d, want 1", refs)
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{
+			name:   "single element",
+			values: []string{"for=192.0.2.60;proto=http;by=203.0.113.43"},
+			want:   []string{"192.0.2.60"},
+		},
+		{
+			name:   "multiple elements",
+			values: []string{"for=192.0.2.43, for=198.51.100.17"},
+			want:   []string{"192.0.2.43", "198.51.100.17"},
+		},
+		{
+			name:   "multiple header lines",
+			values: []string{"for=192.0.2.43", "for=198.51.100.17;proto=https"},
+			want:   []string{"192.0.2.43", "198.51.100.17"},
+		},
+		{
+			name:   "quoted IPv6 with port",
+			values: []string{`for="[2001:db8:cafe::17]:4711"`},
+			want:   []string{"[2001:db8:cafe::17]:4711"},
+		},
+		{
+			name:   "case-insensitive key and whitespace",
+			values: []string{" proto=http ; For = 192.0.2.60 "},
+			want:   []string{"192.0.2.60"},
+		},
+		{
+			name:   "separators inside quotes",
+			values: []string{`for="_gazonk;a,b", for=192.0.2.1`},
+			want:   []string{"_gazonk;a,b", "192.0.2.1"},
+		},
+		{
+			name:   "escaped quote",
+			values: []string{`for="_a\"b"`},
+			want:   []string{`_a"b`},
+		},
+		{
+			name:   "unknown and obfuscated identifiers are kept",
+			values: []string{"for=unknown, for=_hidden"},
+			want:   []string{"unknown", "_hidden"},
+		},
+		{
+			name:   "elements without for",
+			values: []string{"proto=https;by=203.0.113.43", "host=example.com"},
+			want:   nil,
+		},
+		{
+			name:   "malformed pairs",
+			values: []string{"for, =192.0.2.1, for=192.0.2.2"},
+			want:   []string{"192.0.2.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseForwarded(tt.values); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseForwarded(%q) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []string
+	}{
+		{
+			name:   "empty header",
+			header: "",
+			want:   []string{},
+		},
+		{
+			name:   "single language",
+			header: "de",
+			want:   []string{"de"},
+		},
+		{
+			name:   "ordered by quality",
+			header: "en;q=0.5, de, fr;q=0.8",
+			want:   []string{"de", "fr", "en"},
+		},
+		{
+			name:   "region followed by its base language",
+			header: "fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5",
+			want:   []string{"fr-CH", "fr", "en"},
+		},
+		{
+			name:   "header order kept for equal qualities",
+			header: "pt-BR, es, en",
+			want:   []string{"pt-BR", "pt", "es", "en"},
+		},
+		{
+			name:   "zero quality excluded",
+			header: "de, en;q=0",
+			want:   []string{"de"},
+		},
+		{
+			name:   "invalid quality treated as 1",
+			header: "en;q=0.5, de;q=abc",
+			want:   []string{"de", "en"},
+		},
+		{
+			name:   "duplicates ignored case-insensitively",
+			header: "en-US, EN;q=0.9, en-us;q=0.8",
+			want:   []string{"en-US", "en"},
+		},
+		{
+			name:   "wildcard and blanks skipped",
+			header: " , *, ja ",
+			want:   []string{"ja"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseAcceptLanguage(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAcceptLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
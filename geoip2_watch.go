@@ -0,0 +1,147 @@
+package geoip2
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// WatchConfig configures reloading databases as soon as their files change on disk
+// The directories of the database files are watched rather than the files themselves,
+// so files replaced by an atomic rename (as geoipupdate does) are picked up as well
+type WatchConfig struct {
+	// Debounce is how long to wait after the last change of a file before reloading it,
+	// so a burst of writes results in a single reload
+	// Default: 2s
+	Debounce caddy.Duration `json:"debounce,omitempty"`
+}
+
+// Default file watch configuration values
+const (
+	DefaultWatchDebounce = 2 * time.Second
+)
+
+// dirWatcher reports changes of files in a set of directories
+// Implemented with inotify on Linux
+type dirWatcher interface {
+	// run calls changed with the path of every file that is written, created or moved
+	// into a watched directory, until the watcher is closed
+	run(changed func(path string))
+
+	// close stops the watcher and makes run return
+	close() error
+}
+
+// databaseWatcher reloads the databases whose files changed, debounced per database
+type databaseWatcher struct {
+	watcher  dirWatcher
+	debounce time.Duration
+
+	// databases maps the watched file paths to the names of the databases stored there
+	databases map[string][]string
+
+	mutex   sync.Mutex
+	timers  map[string]*time.Timer
+	stopped bool
+}
+
+// startFileWatcher starts watching the directories of all database files
+// Symlinked database paths are watched at both the link and its target
+func (g *GeoIP2State) startFileWatcher() error {
+	w := &databaseWatcher{
+		debounce:  time.Duration(g.Watch.Debounce),
+		databases: make(map[string][]string),
+		timers:    make(map[string]*time.Timer),
+	}
+	if w.debounce <= 0 {
+		w.debounce = DefaultWatchDebounce
+	}
+
+	var dirs []string
+	for _, name := range g.databaseNames() {
+		path := filepath.Clean(g.dbConfigs[name].Path)
+		paths := []string{path}
+		if resolved, err := filepath.EvalSymlinks(path); err == nil && resolved != path {
+			paths = append(paths, resolved)
+		}
+		for _, p := range paths {
+			w.databases[p] = append(w.databases[p], name)
+			if dir := filepath.Dir(p); !containsString(dirs, dir) {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	watcher, err := newDirWatcher(dirs)
+	if err != nil {
+		return err
+	}
+	w.watcher = watcher
+	g.watcher = w
+
+	go watcher.run(func(path string) {
+		w.changed(path, g.performWatchReload)
+	})
+
+	caddy.Log().Named("geoip2").Info("watching database files for changes",
+		zap.Strings("directories", dirs),
+		zap.Duration("debounce", w.debounce))
+	return nil
+}
+
+// changed schedules the reload of the databases stored at path, postponing a pending one
+func (w *databaseWatcher) changed(path string, reload func(name string)) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.stopped {
+		return
+	}
+	for _, name := range w.databases[path] {
+		if timer := w.timers[name]; timer != nil {
+			timer.Reset(w.debounce)
+			continue
+		}
+		w.timers[name] = time.AfterFunc(w.debounce, func() {
+			w.mutex.Lock()
+			stopped := w.stopped
+			w.mutex.Unlock()
+			if !stopped {
+				reload(name)
+			}
+		})
+	}
+}
+
+// stop closes the watcher and cancels all pending reloads
+func (w *databaseWatcher) stop() error {
+	w.mutex.Lock()
+	w.stopped = true
+	for _, timer := range w.timers {
+		timer.Stop()
+	}
+	w.mutex.Unlock()
+
+	return w.watcher.close()
+}
+
+// performWatchReload reloads a database after its file changed
+func (g *GeoIP2State) performWatchReload(name string) {
+	caddy.Log().Named("geoip2").Info("database file changed, reloading",
+		zap.String("database", name))
+
+	startTime := time.Now()
+	if err := g.loadDatabases([]string{name}); err != nil {
+		caddy.Log().Named("geoip2").Error("database reload after file change failed",
+			zap.String("database", name),
+			zap.Error(err),
+			zap.Duration("duration", time.Since(startTime)))
+	} else {
+		caddy.Log().Named("geoip2").Info("database reload after file change completed",
+			zap.String("database", name),
+			zap.Duration("duration", time.Since(startTime)))
+	}
+}
@@ -0,0 +1,99 @@
+//go:build linux
+
+package geoip2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// inotifyEvents are the directory events that indicate a new or rewritten file
+// IN_CLOSE_WRITE covers in-place writes, IN_MOVED_TO atomic renames into the directory
+const inotifyEvents = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE
+
+// inotifyWatcher watches directories using Linux inotify
+type inotifyWatcher struct {
+	// file wraps the non-blocking inotify descriptor, so reads use the runtime poller
+	// and closing the file unblocks a pending read
+	file *os.File
+
+	// dirs maps the watch descriptors to the watched directories
+	dirs map[int32]string
+}
+
+// newDirWatcher creates an inotify watcher for the given directories
+func newDirWatcher(dirs []string) (dirWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("initializing inotify: %v", err)
+	}
+
+	w := &inotifyWatcher{
+		file: os.NewFile(uintptr(fd), "inotify"),
+		dirs: make(map[int32]string, len(dirs)),
+	}
+	for _, dir := range dirs {
+		wd, err := unix.InotifyAddWatch(fd, dir, inotifyEvents|unix.IN_ONLYDIR)
+		if err != nil {
+			w.file.Close()
+			return nil, fmt.Errorf("watching directory %s: %v", dir, err)
+		}
+		w.dirs[int32(wd)] = dir
+	}
+	return w, nil
+}
+
+// run reads inotify events until the watcher is closed
+func (w *inotifyWatcher) run(changed func(path string)) {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				caddy.Log().Named("geoip2").Error("reading inotify events failed, stopped watching database files",
+					zap.Error(err))
+			}
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > n {
+				break
+			}
+			offset = nameEnd
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				caddy.Log().Named("geoip2").Warn("inotify event queue overflowed, file changes may have been missed")
+				continue
+			}
+			if event.Mask&unix.IN_IGNORED != 0 {
+				caddy.Log().Named("geoip2").Warn("watched directory was removed, file changes are no longer detected",
+					zap.String("directory", w.dirs[event.Wd]))
+				continue
+			}
+
+			dir, ok := w.dirs[event.Wd]
+			if !ok || event.Len == 0 {
+				continue
+			}
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			changed(filepath.Join(dir, name))
+		}
+	}
+}
+
+// close closes the inotify descriptor, which also removes all watches
+func (w *inotifyWatcher) close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package geoip2
+
+import "fmt"
+
+// newDirWatcher is not available without inotify
+func newDirWatcher(dirs []string) (dirWatcher, error) {
+	return nil, fmt.Errorf("watching database files requires inotify and is only supported on Linux")
+}
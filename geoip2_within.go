@@ -0,0 +1,357 @@
+package geoip2
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// MatchWithin matches requests whose client IP resolves to a location inside a geo-fence
+// The fence is a circle (center + radius in kilometers, using great-circle distance),
+// the polygons of a GeoJSON file, or both; a request matches if it lies inside any of them
+// IPs without location data in the City database never match
+//
+// Caddyfile usage:
+//
+//	@munich geoip2_within 48.1374 11.5755 50
+//	@region geoip2_within {
+//	  geojson /etc/caddy/region.geojson
+//	}
+type MatchWithin struct {
+	// Latitude is the latitude of the circle center in decimal degrees
+	Latitude float64 `json:"latitude,omitempty"`
+
+	// Longitude is the longitude of the circle center in decimal degrees
+	Longitude float64 `json:"longitude,omitempty"`
+
+	// RadiusKm is the circle radius in kilometers
+	// 0 = no circle fence, only the GeoJSON polygons are used
+	RadiusKm float64 `json:"radius_km,omitempty"`
+
+	// GeoJSONFile is the path to a GeoJSON file containing Polygon or MultiPolygon
+	// geometries (bare, as Feature, or as FeatureCollection)
+	// Example: "/etc/caddy/region.geojson"
+	GeoJSONFile string `json:"geojson_file,omitempty"`
+
+	// polygons holds the polygons loaded from GeoJSONFile at provision time
+	polygons []geoPolygon `json:"-"`
+
+	// state holds reference to the shared GeoIP2 database state
+	state *GeoIP2State `json:"-"`
+}
+
+// earthRadiusKm is the mean Earth radius used for great-circle distances
+const earthRadiusKm = 6371.0088
+
+// Module registration - called when Caddy starts
+func init() {
+	caddy.RegisterModule(MatchWithin{})
+}
+
+// CaddyModule returns module information for Caddy's module system
+func (MatchWithin) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_within",
+		New: func() caddy.Module { return new(MatchWithin) },
+	}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler
+// Parses: geoip2_within <lat> <lon> <radius_km> or the block form with a geojson subdirective
+func (m *MatchWithin) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		args := d.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 3:
+			if m.RadiusKm != 0 {
+				return d.Err("geoip2_within matcher supports only one radius fence")
+			}
+			values := make([]float64, 3)
+			for i, arg := range args {
+				v, err := strconv.ParseFloat(arg, 64)
+				if err != nil {
+					return d.Errf("invalid number '%s': %v", arg, err)
+				}
+				values[i] = v
+			}
+			m.Latitude, m.Longitude, m.RadiusKm = values[0], values[1], values[2]
+		default:
+			return d.ArgErr()
+		}
+
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "geojson":
+				if m.GeoJSONFile != "" {
+					return d.Err("geoip2_within matcher supports only one geojson file")
+				}
+				if !d.Args(&m.GeoJSONFile) {
+					return d.ArgErr()
+				}
+				// Expand environment variables and resolve relative paths
+				m.GeoJSONFile = os.ExpandEnv(m.GeoJSONFile)
+				if !filepath.IsAbs(m.GeoJSONFile) {
+					m.GeoJSONFile, _ = filepath.Abs(m.GeoJSONFile)
+				}
+
+			default:
+				return d.Errf("unknown subdirective: %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Provision links the matcher to the shared GeoIP2 state and loads the GeoJSON polygons
+func (m *MatchWithin) Provision(ctx caddy.Context) error {
+	app, err := ctx.App(moduleName)
+	if err != nil {
+		return fmt.Errorf("getting geoip2 app: %v", err)
+	}
+	m.state = app.(*GeoIP2State)
+
+	if m.GeoJSONFile != "" {
+		polygons, err := loadGeoJSONPolygons(m.GeoJSONFile)
+		if err != nil {
+			return fmt.Errorf("loading geojson file %s: %v", m.GeoJSONFile, err)
+		}
+		m.polygons = polygons
+	}
+
+	return nil
+}
+
+// Validate checks if the configuration is valid
+func (m MatchWithin) Validate() error {
+	if m.RadiusKm == 0 && m.GeoJSONFile == "" {
+		return fmt.Errorf("geoip2_within matcher requires a radius or a geojson file")
+	}
+	if m.RadiusKm < 0 {
+		return fmt.Errorf("radius_km cannot be negative")
+	}
+	if m.Latitude < -90 || m.Latitude > 90 {
+		return fmt.Errorf("latitude must be between -90 and 90, got %v", m.Latitude)
+	}
+	if m.Longitude < -180 || m.Longitude > 180 {
+		return fmt.Errorf("longitude must be between -180 and 180, got %v", m.Longitude)
+	}
+	if m.GeoJSONFile != "" && len(m.polygons) == 0 {
+		return fmt.Errorf("geojson file %s contains no polygons", m.GeoJSONFile)
+	}
+	return nil
+}
+
+// Match returns true if the request's client IP is located inside the geo-fence
+func (m MatchWithin) Match(r *http.Request) bool {
+	match, err := m.MatchWithError(r)
+	if err != nil {
+		caddyhttp.SetVar(r.Context(), caddyhttp.MatcherErrorVarKey, err)
+	}
+	return match
+}
+
+// MatchWithError returns true if the request's client IP is located inside the geo-fence
+// Lookup failures are not treated as errors; the request simply does not match
+func (m MatchWithin) MatchWithError(r *http.Request) (bool, error) {
+	if m.state == nil {
+		return false, nil
+	}
+
+	clientIP, err := resolvedClientIP(r)
+	if err != nil {
+		caddy.Log().Named("http.matchers.geoip2_within").Debug("failed to get client IP",
+			zap.Error(err))
+		return false, nil
+	}
+
+	cityRecord, dbName, err := m.lookupLocation(clientIP)
+	if dbName == "" {
+		return false, nil
+	}
+	if err != nil {
+		caddy.Log().Named("http.matchers.geoip2_within").Debug("City lookup failed",
+			zap.String("ip", clientIP.String()),
+			zap.String("database", dbName),
+			zap.Error(err))
+		return false, nil
+	}
+
+	lat, lon := cityRecord.Location.Latitude, cityRecord.Location.Longitude
+	// 0,0 is what an absent location decodes to
+	if lat == 0 && lon == 0 {
+		return false, nil
+	}
+
+	return m.contains(lat, lon), nil
+}
+
+// lookupLocation looks up the City record of an IP, from the Enterprise database if configured
+// Returns the name of the database that answered
+func (m MatchWithin) lookupLocation(clientIP net.IP) (CityRecord, string, error) {
+	var cityRecord CityRecord
+	if m.state.HasDatabase(DatabaseEnterprise) {
+		err := m.state.LookupEnterprise(clientIP, &cityRecord)
+		return cityRecord, DatabaseEnterprise, err
+	}
+
+	// Country lookup decides which city database is used, same as the handler
+	var countryRecord CountryRecord
+	if err := m.state.Lookup(clientIP, &countryRecord); err != nil {
+		caddy.Log().Named("http.matchers.geoip2_within").Debug("Country lookup failed",
+			zap.String("ip", clientIP.String()),
+			zap.Error(err))
+	}
+	isInEU := countryRecord.Country.IsInEuropeanUnion || countryRecord.RegisteredCountry.IsInEuropeanUnion
+
+	dbName, _, err := m.state.lookupCity(clientIP, countryRecord.Country.ISOCode, countryRecord.Continent.Code, isInEU, &cityRecord)
+	return cityRecord, dbName, err
+}
+
+// contains reports whether the given point lies inside the circle or any polygon
+func (m MatchWithin) contains(lat, lon float64) bool {
+	if m.RadiusKm > 0 && haversineKm(m.Latitude, m.Longitude, lat, lon) <= m.RadiusKm {
+		return true
+	}
+	for _, polygon := range m.polygons {
+		if polygon.contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// haversineKm returns the great-circle distance between two points in kilometers
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const rad = math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// geoPolygon is a polygon with an outer ring and optional holes
+// Rings are lists of [longitude, latitude] positions as in GeoJSON
+type geoPolygon [][][2]float64
+
+// contains reports whether a point lies inside the outer ring and outside all holes
+func (p geoPolygon) contains(lat, lon float64) bool {
+	if len(p) == 0 || !ringContains(p[0], lat, lon) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if ringContains(hole, lat, lon) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains implements the even-odd ray casting test for a single ring
+func ringContains(ring [][2]float64, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// geoJSONObject covers the subset of GeoJSON needed to extract polygons
+type geoJSONObject struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSONObject  `json:"geometry"`
+	Geometries  []geoJSONObject `json:"geometries"`
+	Features    []geoJSONObject `json:"features"`
+}
+
+// loadGeoJSONPolygons reads a GeoJSON file and returns all polygons it contains
+func loadGeoJSONPolygons(path string) ([]geoPolygon, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj geoJSONObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("invalid geojson: %v", err)
+	}
+
+	return obj.polygons()
+}
+
+// polygons recursively collects polygons from GeoJSON objects
+// Non-polygon geometries (points, lines) are ignored
+func (o geoJSONObject) polygons() ([]geoPolygon, error) {
+	switch o.Type {
+	case "FeatureCollection":
+		var result []geoPolygon
+		for _, feature := range o.Features {
+			polygons, err := feature.polygons()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, polygons...)
+		}
+		return result, nil
+
+	case "Feature":
+		if o.Geometry == nil {
+			return nil, nil
+		}
+		return o.Geometry.polygons()
+
+	case "GeometryCollection":
+		var result []geoPolygon
+		for _, geometry := range o.Geometries {
+			polygons, err := geometry.polygons()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, polygons...)
+		}
+		return result, nil
+
+	case "Polygon":
+		var polygon geoPolygon
+		if err := json.Unmarshal(o.Coordinates, &polygon); err != nil {
+			return nil, fmt.Errorf("invalid Polygon coordinates: %v", err)
+		}
+		return []geoPolygon{polygon}, nil
+
+	case "MultiPolygon":
+		var polygons []geoPolygon
+		if err := json.Unmarshal(o.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("invalid MultiPolygon coordinates: %v", err)
+		}
+		return polygons, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// Interface guards - compile-time checks that we implement required interfaces
+var (
+	_ caddy.Module                      = (*MatchWithin)(nil)
+	_ caddy.Provisioner                 = (*MatchWithin)(nil)
+	_ caddy.Validator                   = (*MatchWithin)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchWithin)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchWithin)(nil)
+)